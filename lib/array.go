@@ -0,0 +1,168 @@
+package mongodb
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/segmentio/go-snakecase"
+	"github.com/segmentio/objects-go"
+)
+
+// Strategies to flatten array values, which the Set API does not accept as property values.
+const (
+	// ArrayJSON serializes the array to a JSON string. This is the default.
+	ArrayJSON = "json"
+	// ArrayJoin joins the elements into a single string, separated by Field.Separator.
+	ArrayJoin = "join"
+	// ArrayFirst only keeps the first element.
+	ArrayFirst = "first"
+	// ArrayLast only keeps the last element.
+	ArrayLast = "last"
+	// ArrayLength only keeps the number of elements.
+	ArrayLength = "length"
+	// ArrayExplode publishes every element as an object of its own in a child collection, keyed by
+	// the id of the parent document and the index of the element.
+	ArrayExplode = "explode"
+)
+
+// DefaultArraySeparator is used by ArrayJoin when the field has no separator.
+const DefaultArraySeparator = ","
+
+var arrayStrategies = []string{ArrayJSON, ArrayJoin, ArrayFirst, ArrayLast, ArrayLength, ArrayExplode}
+
+// Properties of the objects published by ArrayExplode.
+const (
+	ParentIDProperty = "parent_id"
+	IndexProperty    = "index"
+	ValueProperty    = "value"
+)
+
+func validArrayStrategy(strategy string) bool {
+	if strategy == "" {
+		return true
+	}
+	for _, s := range arrayStrategies {
+		if s == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+// Flattens an array into a single property value according to the strategy of the field. Returns
+// false if the property should be omitted, e.g. it is empty or exploded into a child collection.
+func flattenArray(value []interface{}, field *Field) (interface{}, bool, error) {
+	strategy, separator := ArrayJSON, DefaultArraySeparator
+	if field != nil {
+		if field.Array != "" {
+			strategy = field.Array
+		}
+		if field.Separator != "" {
+			separator = field.Separator
+		}
+	}
+
+	switch strategy {
+	case ArrayJoin:
+		elements := make([]string, 0, len(value))
+		for _, element := range value {
+			s, err := stringify(element)
+			if err != nil {
+				return nil, false, err
+			}
+			elements = append(elements, s)
+		}
+		return strings.Join(elements, separator), true, nil
+	case ArrayFirst:
+		if len(value) == 0 {
+			return nil, false, nil
+		}
+		return flattenElement(value[0])
+	case ArrayLast:
+		if len(value) == 0 {
+			return nil, false, nil
+		}
+		return flattenElement(value[len(value)-1])
+	case ArrayLength:
+		return len(value), true, nil
+	case ArrayExplode:
+		return nil, false, nil
+	default:
+		arrayJSON, err := json.Marshal(value)
+		if err != nil {
+			return nil, false, err
+		}
+		return string(arrayJSON), true, nil
+	}
+}
+
+// A single element kept out of an array may itself be an array, which then still needs to be
+// serialized. Sub-documents are left as is and get flattened into columns by the client.
+func flattenElement(element interface{}) (interface{}, bool, error) {
+	if element == nil {
+		return nil, false, nil
+	}
+	if array, ok := element.([]interface{}); ok {
+		return flattenArray(array, nil)
+	}
+	return element, true, nil
+}
+
+// Scalars are formatted as is, anything else is serialized to JSON.
+func stringify(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(v)
+		return string(b), err
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// Returns the objects of the child collections of the fields using ArrayExplode. Each element
+// becomes an object identified by `<parent id>_<index>` carrying the parent id, its index and its
+// value.
+func getExplodedObjectsFromResult(id string, result map[string]interface{}, c *Collection, parentDestinationName string) []*objects.Object {
+	var children []*objects.Object
+	for fieldName, field := range c.Fields {
+		if field == nil || field.Array != ArrayExplode {
+			continue
+		}
+
+		array, ok := getForNestedKey(result, fieldName).([]interface{})
+		if !ok {
+			continue
+		}
+
+		destinationName := field.ChildDestinationName(parentDestinationName)
+		for i, element := range array {
+			properties := map[string]interface{}{
+				ParentIDProperty: id,
+				IndexProperty:    i,
+			}
+			if value, ok, err := flattenElement(element); err == nil && ok {
+				if value, ok := field.convert(value); ok {
+					properties[ValueProperty] = value
+				}
+			}
+			children = append(children, &objects.Object{
+				ID:         fmt.Sprintf("%s_%d", id, i),
+				Collection: destinationName,
+				Properties: properties,
+			})
+		}
+	}
+	return children
+}
+
+// ChildDestinationName is the collection elements of the field are exploded into. Unless set
+// explicitly it is named after the parent collection and the field.
+func (f *Field) ChildDestinationName(parentDestinationName string) string {
+	if f.ChildCollection != "" {
+		return f.ChildCollection
+	}
+	return snakecase.Snakecase(parentDestinationName + "_" + f.destinationName())
+}
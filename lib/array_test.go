@@ -0,0 +1,75 @@
+package mongodb
+
+import (
+	"testing"
+
+	"github.com/segmentio/objects-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlattenArray(t *testing.T) {
+	tags := []interface{}{"fruit", "red", 3}
+
+	cases := []struct {
+		field    *Field
+		expected interface{}
+	}{
+		{nil, `["fruit","red",3]`},
+		{&Field{Array: ArrayJSON}, `["fruit","red",3]`},
+		{&Field{Array: ArrayJoin}, "fruit,red,3"},
+		{&Field{Array: ArrayJoin, Separator: "|"}, "fruit|red|3"},
+		{&Field{Array: ArrayFirst}, "fruit"},
+		{&Field{Array: ArrayLast}, 3},
+		{&Field{Array: ArrayLength}, 3},
+	}
+	for _, c := range cases {
+		value, ok, err := flattenArray(tags, c.field)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, c.expected, value)
+	}
+
+	// Exploded arrays and empty arrays picked from have no property at all.
+	_, ok, _ := flattenArray(tags, &Field{Array: ArrayExplode})
+	assert.False(t, ok)
+	_, ok, _ = flattenArray([]interface{}{}, &Field{Array: ArrayFirst})
+	assert.False(t, ok)
+}
+
+func TestGetPropertiesMapFromResultArrays(t *testing.T) {
+	result := map[string]interface{}{
+		"name": "Apple",
+		"tags": []interface{}{"fruit", "red"},
+	}
+	c := &Collection{Fields: map[string]*Field{
+		"name": {FieldName: "name"},
+		"tags": {FieldName: "tags", Array: ArrayLength, DestinationName: "tag_count"},
+	}}
+
+	assert.Equal(t, map[string]interface{}{"name": "Apple", "tag_count": 2}, getPropertiesMapFromResult(result, c))
+}
+
+func TestGetExplodedObjectsFromResult(t *testing.T) {
+	result := map[string]interface{}{
+		"name": "Apple",
+		"tags": []interface{}{"fruit", "red"},
+	}
+	c := &Collection{Fields: map[string]*Field{
+		"name": {FieldName: "name"},
+		"tags": {FieldName: "tags", Array: ArrayExplode},
+	}}
+
+	children := getExplodedObjectsFromResult("abc123", result, c, "test_products")
+	assert.Equal(t, []*objects.Object{
+		{
+			ID:         "abc123_0",
+			Collection: "test_products_tags",
+			Properties: map[string]interface{}{"parent_id": "abc123", "index": 0, "value": "fruit"},
+		},
+		{
+			ID:         "abc123_1",
+			Collection: "test_products_tags",
+			Properties: map[string]interface{}{"parent_id": "abc123", "index": 1, "value": "red"},
+		},
+	}, children)
+}
@@ -0,0 +1,98 @@
+package mongodb
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Types of BSON values, by their `$type` aliases, in the order MongoDB sorts values of different
+// types, e.g. in indexes, chunk ranges or `_id` order. Numbers of all types compare with each other,
+// and so do strings and symbols.
+var bsonTypeOrder = [][]string{
+	{"minKey"},
+	{"null", "undefined"},
+	{"double", "int", "long", "decimal"},
+	{"string", "symbol"},
+	{"object"},
+	{"array"},
+	{"binData"},
+	{"objectId"},
+	{"bool"},
+	{"date"},
+	{"timestamp"},
+	{"regex"},
+	{"maxKey"},
+}
+
+// Rank of null in bsonTypeOrder, which missing fields sort as.
+const nullTypeRank = 1
+
+// Returns the rank of the type of a value decoded by mgo in bsonTypeOrder, or -1 if it is unknown.
+func bsonTypeRank(value interface{}) int {
+	switch value {
+	case bson.MinKey:
+		return 0
+	case bson.MaxKey:
+		return len(bsonTypeOrder) - 1
+	case bson.Undefined:
+		return nullTypeRank
+	}
+	switch value.(type) {
+	case nil:
+		return nullTypeRank
+	case int, int32, int64, float32, float64:
+		return 2
+	case string, bson.Symbol:
+		return 3
+	case map[string]interface{}, bson.M, bson.D:
+		return 4
+	case []interface{}:
+		return 5
+	case []byte, bson.Binary:
+		return 6
+	case bson.ObjectId:
+		return 7
+	case bool:
+		return 8
+	case time.Time:
+		return 9
+	case bson.MongoTimestamp:
+		return 10
+	case bson.RegEx:
+		return 11
+	}
+	return -1
+}
+
+// Returns a filter matching the documents whose field compares to the value with op, one of `$gt`,
+// `$gte`, `$lt` or `$lte`, in the order MongoDB sorts values of different types. Comparison
+// operators only match values of the type of their operand, so values of the types sorting after,
+// or before, the one of the value are matched by their type, and missing fields as null. MinKey and
+// MaxKey compare with values of all types already.
+func compareFilter(field, op string, value interface{}) bson.M {
+	same := bson.M{field: bson.M{op: value}}
+	rank := bsonTypeRank(value)
+	if rank <= 0 || rank >= len(bsonTypeOrder)-1 {
+		return same
+	}
+
+	var types []string
+	missing := false
+	switch op {
+	case "$gt", "$gte":
+		for _, aliases := range bsonTypeOrder[rank+1:] {
+			types = append(types, aliases...)
+		}
+	default:
+		for _, aliases := range bsonTypeOrder[:rank] {
+			types = append(types, aliases...)
+		}
+		missing = rank > nullTypeRank
+	}
+	or := []bson.M{same, {field: bson.M{"$type": types}}}
+	if missing {
+		or = append(or, bson.M{field: bson.M{"$exists": false}})
+	}
+	return bson.M{"$or": or}
+}
@@ -0,0 +1,189 @@
+package mongodb
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Types a field can be cast to. The warehouse type of a column is set by the first value it sees,
+// so fields holding values of mixed types should be cast to a single one.
+const (
+	TypeString    = "string"
+	TypeInt       = "int"
+	TypeFloat     = "float"
+	TypeBool      = "bool"
+	TypeTimestamp = "timestamp"
+)
+
+var types = []string{TypeString, TypeInt, TypeFloat, TypeBool, TypeTimestamp}
+
+// Layouts of the strings that can be cast to timestamps.
+var timestampLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"}
+
+func (f *Field) validateType() error {
+	switch f.Type {
+	case "":
+		if f.Default != nil {
+			return fmt.Errorf("field %q: a default requires a type", f.FieldName)
+		}
+		return nil
+	case TypeString, TypeInt, TypeFloat, TypeBool, TypeTimestamp:
+	default:
+		return fmt.Errorf("field %q: unknown type %q, expected one of %v", f.FieldName, f.Type, types)
+	}
+
+	if f.Default != nil {
+		if _, err := castValue(f.Default, f.Type); err != nil {
+			return fmt.Errorf("field %q: invalid default: %v", f.FieldName, err)
+		}
+	}
+	return nil
+}
+
+// Casts a value to the type of the field. Missing values and values that cannot be cast are
+// replaced by the default of the field, or omitted if it has none. Returns false if the value
+// must be omitted.
+func (f *Field) cast(value interface{}) (interface{}, bool) {
+	if f == nil || f.Type == "" {
+		return value, value != nil
+	}
+
+	if value != nil {
+		if cast, err := castValue(value, f.Type); err == nil {
+			return cast, true
+		}
+		atomic.AddInt64(&f.castFailures, 1)
+		// The error quotes the value, which is left out of logs as it may be personal data.
+		logrus.WithFields(logrus.Fields{
+			"field": f.FieldName,
+			"from":  fmt.Sprintf("%T", value),
+			"to":    f.Type,
+		}).Debug("Unable to cast value")
+	}
+
+	if f.Default == nil {
+		return nil, false
+	}
+	cast, _ := castValue(f.Default, f.Type)
+	return cast, true
+}
+
+// CastFailures returns the number of values of the field that could not be cast to its type.
+func (f *Field) CastFailures() int64 {
+	return atomic.LoadInt64(&f.castFailures)
+}
+
+func castValue(value interface{}, typ string) (interface{}, error) {
+	switch typ {
+	case TypeString:
+		return castString(value)
+	case TypeInt:
+		return castInt(value)
+	case TypeFloat:
+		return castFloat(value)
+	case TypeBool:
+		return castBool(value)
+	case TypeTimestamp:
+		return castTimestamp(value)
+	}
+	return nil, fmt.Errorf("unknown type %q", typ)
+}
+
+func castString(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case bson.ObjectId:
+		return v.Hex(), nil
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano), nil
+	}
+	return stringify(value)
+}
+
+func castInt(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case float64:
+		if v != math.Trunc(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("%v is not a whole number", v)
+		}
+		return int64(v), nil
+	case bool:
+		if v {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case string:
+		return strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	}
+	return nil, fmt.Errorf("cannot cast %T to %s", value, TypeInt)
+}
+
+func castFloat(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return float64(1), nil
+		}
+		return float64(0), nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	}
+	return nil, fmt.Errorf("cannot cast %T to %s", value, TypeFloat)
+}
+
+func castBool(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case int, int32, int64, float64:
+		f, _ := castFloat(v)
+		return f.(float64) != 0, nil
+	case string:
+		return strconv.ParseBool(strings.TrimSpace(v))
+	}
+	return nil, fmt.Errorf("cannot cast %T to %s", value, TypeBool)
+}
+
+// Numbers are taken as seconds since the epoch, ObjectIds as their creation time.
+func castTimestamp(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v.UTC(), nil
+	case bson.ObjectId:
+		return v.Time().UTC(), nil
+	case bson.MongoTimestamp:
+		return time.Unix(int64(v)>>32, 0).UTC(), nil
+	case int, int32, int64, float64:
+		f, _ := castFloat(v)
+		sec, frac := math.Modf(f.(float64))
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), nil
+	case string:
+		for _, layout := range timestampLayouts {
+			if t, err := time.Parse(layout, strings.TrimSpace(v)); err == nil {
+				return t.UTC(), nil
+			}
+		}
+		return nil, fmt.Errorf("%q is not a timestamp", v)
+	}
+	return nil, fmt.Errorf("cannot cast %T to %s", value, TypeTimestamp)
+}
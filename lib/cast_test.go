@@ -0,0 +1,99 @@
+package mongodb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCastValue(t *testing.T) {
+	date := time.Date(2016, 7, 15, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		value    interface{}
+		typ      string
+		expected interface{}
+	}{
+		{42, TypeString, "42"},
+		{1.5, TypeString, "1.5"},
+		{bson.ObjectIdHex("57881f9ce8414cf291b44b4e"), TypeString, "57881f9ce8414cf291b44b4e"},
+		{date, TypeString, "2016-07-15T00:00:00Z"},
+		{map[string]interface{}{"a": 1}, TypeString, `{"a":1}`},
+		{"42", TypeInt, int64(42)},
+		{3.0, TypeInt, int64(3)},
+		{true, TypeInt, int64(1)},
+		{" 1.5 ", TypeFloat, 1.5},
+		{int64(2), TypeFloat, 2.0},
+		{"true", TypeBool, true},
+		{0, TypeBool, false},
+		{"2016-07-15", TypeTimestamp, date},
+		{"2016-07-15T00:00:00Z", TypeTimestamp, date},
+		{1468540800, TypeTimestamp, date},
+	}
+	for _, c := range cases {
+		value, err := castValue(c.value, c.typ)
+		assert.NoError(t, err, fmt.Sprintf("%v to %s", c.value, c.typ))
+		assert.Equal(t, c.expected, value, fmt.Sprintf("%v to %s", c.value, c.typ))
+	}
+
+	for _, c := range []struct {
+		value interface{}
+		typ   string
+	}{
+		{"abc", TypeInt},
+		{1.5, TypeInt},
+		{"abc", TypeFloat},
+		{"maybe", TypeBool},
+		{"yesterday", TypeTimestamp},
+		{[]interface{}{1}, TypeBool},
+	} {
+		_, err := castValue(c.value, c.typ)
+		assert.Error(t, err, fmt.Sprintf("%v to %s", c.value, c.typ))
+	}
+}
+
+func TestGetPropertiesMapFromResultCasts(t *testing.T) {
+	desc, err := NewDescriptionFromReader(strings.NewReader(`{"test": {"products": {"fields": {
+		"cost": {"type": "float"},
+		"stock": {"type": "int", "default": -1},
+		"rating": {"type": "int"},
+		"tags": {"type": "int", "array": "length"}
+	}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := desc.schemas["test"]["products"]
+
+	properties := getPropertiesMapFromResult(map[string]interface{}{
+		"cost":   "1.27",
+		"rating": "great",
+		"tags":   []interface{}{"fruit", "red"},
+	}, c)
+
+	assert.Equal(t, map[string]interface{}{
+		"cost":  1.27,
+		"stock": int64(-1),
+		"tags":  int64(2),
+	}, properties, "missing values get the default, uncastable values without default are omitted")
+	assert.Equal(t, int64(1), c.Fields["rating"].CastFailures())
+	assert.Equal(t, int64(0), c.Fields["stock"].CastFailures())
+}
+
+func TestComputedCastFailures(t *testing.T) {
+	desc, err := NewDescriptionFromReader(strings.NewReader(`{"test": {"products": {
+		"fields": {"cost": {"type": "float"}},
+		"computed": {"price": {"expression": "{{.cost}} USD", "type": "float"}}
+	}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := desc.schemas["test"]["products"]
+
+	properties := getPropertiesMapFromResult(map[string]interface{}{"cost": 1.5}, c)
+	assert.Equal(t, map[string]interface{}{"cost": 1.5}, properties)
+	assert.Equal(t, []*Field{c.Computed["price"]}, c.castFailedFields())
+}
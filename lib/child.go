@@ -0,0 +1,89 @@
+package mongodb
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/segmentio/go-snakecase"
+	"github.com/segmentio/objects-go"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Child extracts the sub-documents of an array into a collection of their own. Each sub-document
+// is mapped with the fields of the child like a document of a regular collection, and gets the id
+// of its parent document and its index in the array as additional properties. Children may have
+// children of their own.
+type Child struct {
+	Collection
+	// Path of the array in the parent document, in dot syntax.
+	Path string `json:"-"`
+	// IDField is the field of the sub-document holding its id. If empty the id is generated from
+	// the parent id and the index of the sub-document in the array.
+	IDField string `json:"id_field,omitempty"`
+}
+
+// Returns the name of the child collection in the warehouse. Unless set explicitly it is named
+// after the parent collection and the path of the array.
+func (c *Child) destinationName(parentDestinationName string) string {
+	if c.DestinationName != "" {
+		return c.DestinationName
+	}
+	return snakecase.Snakecase(parentDestinationName + "_" + c.Path)
+}
+
+// Returns the id of the sub-document at the given index.
+func (c *Child) getID(parentID string, index int, element map[string]interface{}) (string, error) {
+	if c.IDField == "" {
+		return fmt.Sprintf("%s_%d", parentID, index), nil
+	}
+
+	switch id := getForNestedKey(element, c.IDField).(type) {
+	case nil:
+		return "", fmt.Errorf("'%s' is missing from element %d of '%s'", c.IDField, index, c.Path)
+	case string:
+		return id, nil
+	case bson.ObjectId:
+		return id.Hex(), nil
+	default:
+		return fmt.Sprint(id), nil
+	}
+}
+
+// Returns the object of a document along with all the objects extracted from it: the elements of
+// exploded arrays and the sub-documents of child collections.
+func getObjectsFromResult(id string, result map[string]interface{}, c *Collection, destinationName string) []*objects.Object {
+	objs := []*objects.Object{{
+		ID:         id,
+		Collection: destinationName,
+		Properties: getPropertiesMapFromResult(result, c),
+	}}
+	objs = append(objs, getExplodedObjectsFromResult(id, result, c, destinationName)...)
+
+	for _, child := range c.Children {
+		array, ok := getForNestedKey(result, child.Path).([]interface{})
+		if !ok {
+			continue
+		}
+
+		childDestinationName := child.destinationName(destinationName)
+		for i, element := range array {
+			element, ok := element.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			childID, err := child.getID(id, i, element)
+			if err != nil {
+				logrus.WithError(err).WithField("id", id).Warn("Skipping child document")
+				continue
+			}
+
+			childObjects := getObjectsFromResult(childID, element, &child.Collection, childDestinationName)
+			childObjects[0].Properties[ParentIDProperty] = id
+			childObjects[0].Properties[IndexProperty] = i
+			objs = append(objs, childObjects...)
+		}
+	}
+
+	return objs
+}
@@ -0,0 +1,85 @@
+package mongodb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/segmentio/objects-go"
+	"github.com/stretchr/testify/assert"
+)
+
+const orderSchema = `{
+	"test": {
+		"orders": {
+			"fields": {"total": null},
+			"children": {
+				"line_items": {
+					"destination_name": "order_line_items",
+					"fields": {"sku": null, "qty": {"destination_name": "quantity"}}
+				},
+				"payments": {
+					"id_field": "ref",
+					"fields": {"amount": null}
+				}
+			}
+		}
+	}
+}`
+
+func TestGetObjectsFromResultChildren(t *testing.T) {
+	desc, err := NewDescriptionFromReader(strings.NewReader(orderSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := desc.schemas["test"]["orders"]
+
+	result := map[string]interface{}{
+		"total": 12.5,
+		"line_items": []interface{}{
+			map[string]interface{}{"sku": "apple", "qty": 2},
+			"not a document",
+			map[string]interface{}{"sku": "pear", "qty": 1},
+		},
+		"payments": []interface{}{
+			map[string]interface{}{"ref": "p-1", "amount": 12.5},
+			map[string]interface{}{"amount": 1},
+		},
+	}
+
+	objs := getObjectsFromResult("o1", result, c, "test_orders")
+	byID := make(map[string]*objects.Object)
+	for _, o := range objs {
+		byID[o.ID] = o
+	}
+
+	assert.Len(t, objs, 4, "non-documents and children without an id are skipped")
+	assert.Equal(t, &objects.Object{
+		ID:         "o1",
+		Collection: "test_orders",
+		Properties: map[string]interface{}{"total": 12.5},
+	}, byID["o1"])
+	assert.Equal(t, &objects.Object{
+		ID:         "o1_2",
+		Collection: "order_line_items",
+		Properties: map[string]interface{}{"sku": "pear", "quantity": 1, "parent_id": "o1", "index": 2},
+	}, byID["o1_2"])
+	assert.Equal(t, &objects.Object{
+		ID:         "p-1",
+		Collection: "test_orders_payments",
+		Properties: map[string]interface{}{"amount": 12.5, "parent_id": "o1", "index": 0},
+	}, byID["p-1"])
+	assert.Contains(t, byID, "o1_0")
+}
+
+func TestCollectionProjectionIncludesChildren(t *testing.T) {
+	desc, err := NewDescriptionFromReader(strings.NewReader(orderSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]interface{}{
+		"total":      1,
+		"line_items": 1,
+		"payments":   1,
+	}, desc.schemas["test"]["orders"].projection())
+}
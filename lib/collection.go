@@ -1,14 +1,150 @@
 package mongodb
 
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
 type Field struct {
 	FieldName       string `json:"-"`
 	DestinationName string `json:"destination_name"`
+	// Array is the strategy used to flatten array values, see ArrayJSON and friends.
+	Array string `json:"array,omitempty"`
+	// Separator between elements when Array is ArrayJoin.
+	Separator string `json:"separator,omitempty"`
+	// ChildCollection is the destination of the elements when Array is ArrayExplode.
+	ChildCollection string `json:"child_collection,omitempty"`
+	// Transform hides personal data before it is published, see TransformDrop and friends.
+	Transform string `json:"transform,omitempty"`
+	// Salt prepended to values hashed with TransformSHA256.
+	Salt string `json:"salt,omitempty"`
+	// Key of TransformHMAC.
+	Key string `json:"key,omitempty"`
+	// Length of the values kept by TransformTruncate, or of the suffix left by TransformMask.
+	Length int `json:"length,omitempty"`
+	// Type the values are cast to, see TypeString and friends.
+	Type string `json:"type,omitempty"`
+	// Default replaces missing values and values that cannot be cast to Type.
+	Default interface{} `json:"default,omitempty"`
+	// Expression of a computed field, see computedFuncs.
+	Expression string `json:"expression,omitempty"`
+	// Reference to another collection to pull fields from.
+	Reference *Reference `json:"reference,omitempty"`
+
+	template     *template.Template
+	castFailures int64
+}
+
+// The field name (e.g. name of the field in the warehouse) can be set by the user,
+// otherwise it just defaults to the field name in Mongo.
+func (f *Field) destinationName() string {
+	if f.DestinationName != "" {
+		return f.DestinationName
+	}
+	return f.FieldName
+}
+
+// Casts a value to the type of the field then applies its transform, returns false if the value
+// must be omitted.
+func (f *Field) convert(value interface{}) (interface{}, bool) {
+	value, ok := f.cast(value)
+	if !ok {
+		return nil, false
+	}
+	// Transforms are applied last, to the value that would have been published otherwise.
+	return f.applyTransform(value)
 }
 
+func (f *Field) validate() error {
+	if !validArrayStrategy(f.Array) {
+		return fmt.Errorf("field %q: unknown array strategy %q, expected one of %v", f.FieldName, f.Array, arrayStrategies)
+	}
+	if strings.Contains(f.FieldName, wildcard) && !isPattern(f.FieldName) {
+		return fmt.Errorf("field %q: wildcards are only supported as the last part of a field name", f.FieldName)
+	}
+	if isPattern(f.FieldName) && f.Array == ArrayExplode {
+		return fmt.Errorf("field %q: wildcard fields cannot be exploded", f.FieldName)
+	}
+	if err := f.validateType(); err != nil {
+		return err
+	}
+	if f.Reference != nil {
+		if err := f.Reference.validate(f); err != nil {
+			return err
+		}
+	}
+	return f.validateTransform()
+}
+
+// Modes of a collection, which define how Collection.Fields are interpreted.
+const (
+	// ModeInclude only exports the fields listed. This is the default.
+	ModeInclude = "include"
+	// ModeExclude exports every field of the documents except the ones listed, flattening nested
+	// fields into properties of their own.
+	ModeExclude = "exclude"
+)
+
 type Collection struct {
 	CollectionName  string            `json:"-"`
 	DestinationName string            `json:"destination_name,omitempty"`
+	Mode            string            `json:"mode,omitempty"`
 	Fields          map[string]*Field `json:"fields"`
+	// Children extracts arrays of sub-documents into collections of their own, by array path.
+	Children map[string]*Child `json:"children,omitempty"`
+	// Computed fields derived from the document with an expression, by destination name.
+	Computed map[string]*Field `json:"computed,omitempty"`
+	// Pipeline makes this a virtual collection whose documents are the results of an aggregation
+	// pipeline run over the Source collection.
+	Source   string          `json:"source,omitempty"`
+	Pipeline json.RawMessage `json:"pipeline,omitempty"`
+	// Kind of the collection in Mongo, see KindView and friends. Set by `--init` and refreshed
+	// from the database before scanning.
+	Kind string `json:"kind,omitempty"`
+	// Cursor tunes the cursor scanning the collection, overriding the global options.
+	Cursor *CursorOptions `json:"cursor,omitempty"`
+
+	// Destination name resolved by the naming policy.
+	destination string
+	pipeline    []bson.D
+	// Time field of a time-series collection, only set if an index sorts documents by it.
+	timeField string
+}
+
+// Names are the keys of the JSON objects, fill them in so that collections and fields are
+// self-contained. Fields left empty (null) get their default settings.
+func (c *Collection) init(collectionName string) {
+	c.CollectionName = collectionName
+	for fieldName, field := range c.Fields {
+		if field == nil {
+			field = &Field{}
+			c.Fields[fieldName] = field
+		}
+		field.FieldName = fieldName
+		if field.Reference != nil {
+			field.Reference.init(field)
+		}
+	}
+	for name, field := range c.Computed {
+		if field == nil {
+			field = &Field{}
+			c.Computed[name] = field
+		}
+		field.FieldName = name
+	}
+	for path, child := range c.Children {
+		if child == nil {
+			child = &Child{}
+			c.Children[path] = child
+		}
+		child.Path = path
+		child.init(collectionName + "." + path)
+	}
 }
 
 func (c *Collection) GetFieldNames() []string {
@@ -22,3 +158,142 @@ func (c *Collection) GetFieldNames() []string {
 
 	return keys
 }
+
+func (c *Collection) validate() error {
+	switch c.Mode {
+	case "", ModeInclude:
+	case ModeExclude:
+		for fieldName, field := range c.Fields {
+			if field != nil && field.Transform != "" {
+				return fmt.Errorf("collection %q: field %q is excluded, so it cannot have a transform", c.CollectionName, fieldName)
+			}
+			if strings.Contains(fieldName, wildcard) {
+				return fmt.Errorf("collection %q: wildcard field %q cannot be excluded", c.CollectionName, fieldName)
+			}
+			if fieldName == "_id" {
+				return fmt.Errorf("collection %q: `_id` cannot be excluded", c.CollectionName)
+			}
+		}
+	default:
+		return fmt.Errorf("collection %q: unknown mode %q, expected %q or %q", c.CollectionName, c.Mode, ModeInclude, ModeExclude)
+	}
+	if !validKind(c.Kind) {
+		return fmt.Errorf("collection %q: unknown kind %q, expected %q, %q or %q", c.CollectionName, c.Kind, KindView, KindCapped, KindTimeSeries)
+	}
+	for _, field := range c.Fields {
+		if err := field.validate(); err != nil {
+			return fmt.Errorf("collection %q: %v", c.CollectionName, err)
+		}
+	}
+	for _, field := range c.Computed {
+		if err := field.compile(); err != nil {
+			return fmt.Errorf("collection %q: %v", c.CollectionName, err)
+		}
+		if err := field.validate(); err != nil {
+			return fmt.Errorf("collection %q: %v", c.CollectionName, err)
+		}
+	}
+	if len(c.Pipeline) > 0 {
+		if c.Source == "" {
+			return fmt.Errorf("collection %q: a pipeline requires a source collection", c.CollectionName)
+		}
+		pipeline, err := parsePipeline(c.Pipeline)
+		if err != nil {
+			return fmt.Errorf("collection %q: %v", c.CollectionName, err)
+		}
+		c.pipeline = pipeline
+	} else if c.Source != "" {
+		return fmt.Errorf("collection %q: a source collection requires a pipeline", c.CollectionName)
+	}
+	if c.IsVirtual() && c.Kind != "" {
+		return fmt.Errorf("collection %q: aggregations have no kind", c.CollectionName)
+	}
+	if err := c.Cursor.Validate(); err != nil {
+		return fmt.Errorf("collection %q: %v", c.CollectionName, err)
+	}
+	for _, child := range c.Children {
+		if child.Source != "" || len(child.Pipeline) > 0 {
+			return fmt.Errorf("collection %q: children cannot be aggregations", child.CollectionName)
+		}
+		if child.hasReferences() {
+			return fmt.Errorf("collection %q: fields of children cannot be references", child.CollectionName)
+		}
+		if err := child.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Collection) hasReferences() bool {
+	for _, field := range c.Fields {
+		if field != nil && field.Reference != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns false if no fields are specified in the schema, unless all fields are exported, in which
+// case the collection is skipped.
+func (c *Collection) scanned() bool {
+	return c.Mode == ModeExclude || len(c.Fields) > 0 || len(c.Children) > 0 || len(c.Computed) > 0
+}
+
+// IsVirtual returns true if the documents of the collection come from an aggregation pipeline.
+func (c *Collection) IsVirtual() bool {
+	return c.pipeline != nil
+}
+
+// Returns the paths of the document that must be fetched from Mongo, or nil for all of them. In
+// exclude mode these are the paths that must not be fetched instead.
+func (c *Collection) projection() map[string]interface{} {
+	if c.Mode == ModeExclude {
+		fieldsToExclude := projectPaths(c.GetFieldNames())
+		for path := range fieldsToExclude {
+			fieldsToExclude[path] = 0
+		}
+		return fieldsToExclude
+	}
+
+	paths := c.GetFieldNames()
+	for path := range c.Children {
+		paths = append(paths, path)
+	}
+	for _, field := range c.Computed {
+		referenced, ok := field.referencedPaths()
+		if !ok {
+			return nil
+		}
+		paths = append(paths, referenced...)
+	}
+	return projectPaths(paths)
+}
+
+// Logs the fields of the collection and its children that had values which could not be cast.
+func (c *Collection) reportCastFailures() {
+	for _, field := range c.castFailedFields() {
+		logrus.WithFields(logrus.Fields{
+			"collection": c.CollectionName,
+			"field":      field.FieldName,
+			"type":       field.Type,
+			"failures":   field.CastFailures(),
+		}).Warn("Some values could not be cast")
+	}
+	for _, child := range c.Children {
+		child.reportCastFailures()
+	}
+}
+
+// Returns the fields and computed fields of the collection that had values which could not be cast.
+func (c *Collection) castFailedFields() []*Field {
+	var failed []*Field
+	for _, fields := range []map[string]*Field{c.Fields, c.Computed} {
+		for _, field := range fields {
+			if field.CastFailures() > 0 {
+				failed = append(failed, field)
+			}
+		}
+	}
+	return failed
+}
@@ -0,0 +1,186 @@
+package mongodb
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// Computed fields derive a property from the document with a Go template, e.g.
+// `{{.first}} {{.last}}` or `{{eq .status "active"}}`. The output of the template is a string, which
+// is then cast to the type of the field if it has one. Fields that are missing or null are nil, so
+// they can be tested with `if` or `coalesce`, and print as nothing; an empty output is absent, the
+// computed field is then omitted or gets its default.
+var computedFuncs = template.FuncMap{
+	// field returns the value at a path in dot syntax, or nil if it is missing.
+	"field": func(doc map[string]interface{}, path string) interface{} {
+		return getForNestedKey(doc, path)
+	},
+	// coalesce returns the first of its arguments that is neither nil nor an empty string.
+	"coalesce": func(values ...interface{}) interface{} {
+		for _, v := range values {
+			if v != nil && v != "" {
+				return v
+			}
+		}
+		return nil
+	},
+	// in reports whether the value is one of the given ones.
+	"in": func(value interface{}, values ...interface{}) bool {
+		for _, v := range values {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+	// printable replaces nil by an empty string, see printNilAsEmpty.
+	printableFunc: func(value interface{}) interface{} {
+		if value == nil {
+			return ""
+		}
+		return value
+	},
+}
+
+const printableFunc = "printable"
+
+// Parses the expression of a computed field.
+func (f *Field) compile() error {
+	if f.Expression == "" {
+		return fmt.Errorf("computed field %q: missing expression", f.FieldName)
+	}
+
+	t, err := template.New(f.FieldName).Funcs(computedFuncs).Option("missingkey=zero").Parse(f.Expression)
+	if err != nil {
+		return fmt.Errorf("computed field %q: %v", f.FieldName, err)
+	}
+	printNilAsEmpty(t.Tree, t.Tree.Root)
+	f.template = t
+	return nil
+}
+
+// Pipes the value printed by every action of a template into printableFunc, so that nil values
+// print as nothing rather than as `<no value>`.
+func printNilAsEmpty(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			printNilAsEmpty(tree, child)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 {
+			return
+		}
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+			NodeType: parse.NodeCommand,
+			Pos:      n.Pos,
+			Args:     []parse.Node{parse.NewIdentifier(printableFunc).SetTree(tree).SetPos(n.Pos)},
+		})
+	case *parse.IfNode:
+		printNilAsEmpty(tree, n.List)
+		printNilAsEmpty(tree, n.ElseList)
+	case *parse.RangeNode:
+		printNilAsEmpty(tree, n.List)
+		printNilAsEmpty(tree, n.ElseList)
+	case *parse.WithNode:
+		printNilAsEmpty(tree, n.List)
+		printNilAsEmpty(tree, n.ElseList)
+	}
+}
+
+// Evaluates the expression of a computed field against a document. Returns nil if the evaluation
+// failed or the output is empty.
+func (f *Field) evaluate(doc map[string]interface{}) interface{} {
+	var b bytes.Buffer
+	if err := f.template.Execute(&b, doc); err != nil || b.Len() == 0 {
+		return nil
+	}
+	return b.String()
+}
+
+// Returns the paths of the document an expression refers to, or false if they cannot be told, e.g.
+// the expression uses `.` on its own or `range`.
+func (f *Field) referencedPaths() ([]string, bool) {
+	if f.template == nil || f.template.Tree == nil {
+		return nil, true
+	}
+	var paths []string
+	ok := collectPaths(f.template.Tree.Root, &paths)
+	return paths, ok
+}
+
+func collectPaths(node parse.Node, paths *[]string) bool {
+	switch n := node.(type) {
+	case nil:
+		return true
+	case *parse.ListNode:
+		if n == nil {
+			return true
+		}
+		for _, child := range n.Nodes {
+			if !collectPaths(child, paths) {
+				return false
+			}
+		}
+		return true
+	case *parse.ActionNode:
+		return collectPaths(n.Pipe, paths)
+	case *parse.IfNode:
+		return collectPaths(n.Pipe, paths) && collectPaths(n.List, paths) && collectPaths(n.ElseList, paths)
+	case *parse.PipeNode:
+		if n == nil {
+			return true
+		}
+		for _, cmd := range n.Cmds {
+			if !collectPaths(cmd, paths) {
+				return false
+			}
+		}
+		return true
+	case *parse.CommandNode:
+		// `field . "a.b"` refers to the path given as a string.
+		if len(n.Args) == 3 {
+			if ident, ok := n.Args[0].(*parse.IdentifierNode); ok && ident.Ident == "field" {
+				if path, ok := n.Args[2].(*parse.StringNode); ok {
+					if _, ok := n.Args[1].(*parse.DotNode); ok {
+						*paths = append(*paths, path.Text)
+						return true
+					}
+				}
+			}
+		}
+		for _, arg := range n.Args {
+			if !collectPaths(arg, paths) {
+				return false
+			}
+		}
+		return true
+	case *parse.FieldNode:
+		*paths = append(*paths, strings.Join(n.Ident, "."))
+		return true
+	case *parse.VariableNode:
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			*paths = append(*paths, strings.Join(n.Ident[1:], "."))
+			return true
+		}
+		return n.Ident[0] != "$"
+	case *parse.ChainNode:
+		return false
+	case *parse.DotNode:
+		return false
+	case *parse.TextNode, *parse.StringNode, *parse.NumberNode, *parse.BoolNode, *parse.NilNode,
+		*parse.IdentifierNode:
+		return true
+	}
+	// range, with, template and anything else change or hide what dot refers to.
+	return false
+}
@@ -0,0 +1,93 @@
+package mongodb
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const computedSchema = `{"test": {"users": {
+	"fields": {"email": null},
+	"computed": {
+		"full_name": {"expression": "{{.name.first}} {{.name.last}}"},
+		"active": {"expression": "{{in .status \"active\" \"trial\"}}", "type": "bool"},
+		"nickname": {"expression": "{{coalesce (field . \"nick\") (field . \"name.first\") | lower}}"},
+		"plan": {"expression": "{{.plan}}", "default": "free", "type": "string"}
+	}
+}}}`
+
+func TestGetPropertiesMapFromResultComputed(t *testing.T) {
+	desc, err := NewDescriptionFromReader(strings.NewReader(computedSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	properties := getPropertiesMapFromResult(map[string]interface{}{
+		"email":  "jane@example.com",
+		"status": "trial",
+		"name":   map[string]interface{}{"first": "Jane", "last": "Doe"},
+	}, desc.schemas["test"]["users"])
+
+	assert.Equal(t, map[string]interface{}{
+		"email":     "jane@example.com",
+		"full_name": "Jane Doe",
+		"active":    true,
+		"nickname":  "jane",
+		"plan":      "free",
+	}, properties)
+}
+
+func TestGetPropertiesMapFromResultComputedNull(t *testing.T) {
+	desc, err := NewDescriptionFromReader(strings.NewReader(computedSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	properties := getPropertiesMapFromResult(map[string]interface{}{
+		"email": nil,
+		"name":  map[string]interface{}{"first": "Jane", "last": nil},
+		"plan":  nil,
+	}, desc.schemas["test"]["users"])
+
+	assert.Equal(t, map[string]interface{}{
+		"full_name": "Jane ",
+		"active":    false,
+		"nickname":  "jane",
+		"plan":      "free",
+	}, properties)
+
+	// Values are printed as they are, even when they look like what templates print for nil.
+	properties = getPropertiesMapFromResult(map[string]interface{}{
+		"status": "active",
+		"plan":   "<no value>",
+	}, desc.schemas["test"]["users"])
+	assert.Equal(t, "<no value>", properties["plan"])
+	assert.Nil(t, properties["full_name"], "missing parent documents fail the evaluation")
+}
+
+func TestComputedProjection(t *testing.T) {
+	desc, err := NewDescriptionFromReader(strings.NewReader(computedSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	projection := desc.schemas["test"]["users"].projection()
+	paths := []string{}
+	for path := range projection {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	assert.Equal(t, []string{"email", "name.first", "name.last", "nick", "plan", "status"}, paths)
+
+	// Expressions using dot on its own need the whole document.
+	desc, err = NewDescriptionFromReader(strings.NewReader(`{"test": {"users": {
+		"fields": {"email": null},
+		"computed": {"keys": {"expression": "{{len .}}"}}
+	}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, desc.schemas["test"]["users"].projection())
+}
@@ -1,12 +1,14 @@
 package mongodb
 
+import "time"
+
 type Config struct {
 	Init     bool
-	Hostname string `valid:"host"`
-	Port     string `valid:"port"`
+	Hostname string `valid:"host~hostname must be a valid host name or IP address,required~hostname is required"`
+	Port     string `valid:"port~port must be a number between 1 and 65535,required~port is required"`
 	Username string
 	Password string
-	Database string
+	Database string `valid:"required~database is required"`
 	// Direct if enabled will disables the automatic replica set server discovery logic, and
 	// forces the use of servers provided only (even if secondaries).
 	// Note that to talk to a secondary the consistency requirements
@@ -14,4 +16,39 @@ type Config struct {
 	Direct bool
 	// Secondary = only connect to secondary servers
 	Secondary bool
+	// StateDir is the directory where the state of previous runs is kept.
+	StateDir string
+	// DetectDeletes publishes a tombstone for documents that disappeared since the previous run.
+	DetectDeletes bool
+	// SkipUnchanged only publishes documents whose content changed since the previous run.
+	SkipUnchanged bool
+	// ForceFull publishes every document even if SkipUnchanged is set. Hashes are still recorded.
+	ForceFull bool
+	// IncludeSystem lists the `system.*` collections in the schema generated by Init.
+	IncludeSystem bool
+	// ShardParallel scans the shards of sharded collections in parallel, through the router.
+	ShardParallel bool
+	// Cursor holds the default cursor options of all collections.
+	Cursor *CursorOptions
+	// RetryMaxElapsed is the time allowed for opening a failed cursor again, 0 to fail right away.
+	RetryMaxElapsed time.Duration
+	// RateLimit caps the read rate of all collections together, nil for no limit.
+	RateLimit *RateLimit
+	// MaxLag is the replication lag above which secondaries are not read from, 0 for no limit.
+	MaxLag time.Duration
+	// MaxLagWait is how long to wait for a secondary to catch up before failing a scan.
+	MaxLagWait time.Duration
+	// ReadConcern of all the reads of a run, see ReadConcernLocal and friends. Empty for the
+	// default of the server.
+	ReadConcern string
+	// Stream the changes logged in the oplog once the collections were scanned, from the position of
+	// the oplog before the scans, until interrupted.
+	Stream bool
+	// Sink holds the settings of the delivery of objects, which are recorded in the report of the
+	// run.
+	Sink *SinkConfig
+	// ReportPath is where the report of the run is saved as JSON, empty for nowhere.
+	ReportPath string
+	// Naming derives destination names, defaults to NewNamingPolicy() if nil.
+	Naming *NamingPolicy
 }
@@ -0,0 +1,119 @@
+package mongodb
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// CursorOptions tune the cursors scanning collections. Zero values leave the defaults of the driver
+// and the server.
+type CursorOptions struct {
+	// BatchSize is the number of documents fetched per round trip.
+	BatchSize int `json:"batch_size,omitempty"`
+	// Prefetch is the ratio of the batch left in memory when the next one is requested, between 0
+	// and 1.
+	Prefetch *float64 `json:"prefetch,omitempty"`
+	// NoCursorTimeout keeps the cursor open on the server even when it is idle for more than 10
+	// minutes, e.g. while a slow batch is being published.
+	NoCursorTimeout *bool `json:"no_cursor_timeout,omitempty"`
+	// MaxTimeMS aborts queries running for longer, in milliseconds.
+	MaxTimeMS int64 `json:"max_time_ms,omitempty"`
+	// Sort fields, prefixed with `-` for descending order.
+	Sort []string `json:"sort,omitempty"`
+	// Hint forces the index with these key fields, prefixed with `-` for descending order.
+	Hint []string `json:"hint,omitempty"`
+}
+
+// ParseFieldList splits a comma separated list of fields as given on the command line.
+func ParseFieldList(s string) []string {
+	var fields []string
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+func (o *CursorOptions) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.BatchSize < 0 {
+		return fmt.Errorf("cursor batch size must not be negative")
+	}
+	if o.Prefetch != nil && (*o.Prefetch < 0 || *o.Prefetch > 1) {
+		return fmt.Errorf("cursor prefetch must be between 0 and 1")
+	}
+	if o.MaxTimeMS < 0 {
+		return fmt.Errorf("cursor max time must not be negative")
+	}
+	for _, field := range append(append([]string{}, o.Sort...), o.Hint...) {
+		if strings.TrimLeft(field, "+-") == "" {
+			return fmt.Errorf("cursor sort and hint fields must not be empty")
+		}
+	}
+	return nil
+}
+
+// Returns the options of a collection, falling back to the global ones for those it does not set.
+func (o *CursorOptions) merge(collection *CursorOptions) *CursorOptions {
+	merged := &CursorOptions{}
+	if o != nil {
+		*merged = *o
+	}
+	if collection == nil {
+		return merged
+	}
+	if collection.BatchSize != 0 {
+		merged.BatchSize = collection.BatchSize
+	}
+	if collection.Prefetch != nil {
+		merged.Prefetch = collection.Prefetch
+	}
+	if collection.NoCursorTimeout != nil {
+		merged.NoCursorTimeout = collection.NoCursorTimeout
+	}
+	if collection.MaxTimeMS != 0 {
+		merged.MaxTimeMS = collection.MaxTimeMS
+	}
+	if len(collection.Sort) > 0 {
+		merged.Sort = collection.Sort
+	}
+	if len(collection.Hint) > 0 {
+		merged.Hint = collection.Hint
+	}
+	return merged
+}
+
+func (o *CursorOptions) noCursorTimeout() bool {
+	return o.NoCursorTimeout != nil && *o.NoCursorTimeout
+}
+
+// Applies the options to a query, except for the sort, see sortFields.
+func (o *CursorOptions) apply(query *mgo.Query) *mgo.Query {
+	if o.BatchSize > 0 {
+		query = query.Batch(o.BatchSize)
+	}
+	if o.Prefetch != nil {
+		query = query.Prefetch(*o.Prefetch)
+	}
+	if o.MaxTimeMS > 0 {
+		query = query.SetMaxTime(time.Duration(o.MaxTimeMS) * time.Millisecond)
+	}
+	if len(o.Hint) > 0 {
+		query = query.Hint(o.Hint...)
+	}
+	return query
+}
+
+// Applies the options supported by aggregations to a pipe.
+func (o *CursorOptions) applyPipe(pipe *mgo.Pipe) *mgo.Pipe {
+	if o.BatchSize > 0 {
+		pipe = pipe.Batch(o.BatchSize)
+	}
+	return pipe
+}
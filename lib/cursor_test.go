@@ -0,0 +1,42 @@
+package mongodb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursorOptionsMerge(t *testing.T) {
+	enabled, disabled := true, false
+	prefetch, noPrefetch := 0.5, 0.0
+	global := &CursorOptions{BatchSize: 1000, Prefetch: &prefetch, NoCursorTimeout: &enabled, Sort: []string{"_id"}}
+
+	desc, err := NewDescriptionFromReader(strings.NewReader(`{"test": {"events": {
+		"fields": {"name": null},
+		"cursor": {"batch_size": 50, "prefetch": 0, "no_cursor_timeout": false, "max_time_ms": 60000, "hint": ["created_at", "-_id"]}
+	}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := desc.schemas["test"]["events"]
+
+	assert.Equal(t, &CursorOptions{
+		BatchSize:       50,
+		Prefetch:        &noPrefetch,
+		NoCursorTimeout: &disabled,
+		MaxTimeMS:       60000,
+		Sort:            []string{"_id"},
+		Hint:            []string{"created_at", "-_id"},
+	}, global.merge(c.Cursor))
+	assert.False(t, global.merge(c.Cursor).noCursorTimeout())
+
+	assert.Equal(t, global, global.merge(nil))
+	assert.True(t, global.merge(nil).noCursorTimeout())
+	assert.Equal(t, &CursorOptions{}, (*CursorOptions)(nil).merge(nil))
+}
+
+func TestParseFieldList(t *testing.T) {
+	assert.Equal(t, []string{"created_at", "-_id"}, ParseFieldList("created_at, -_id"))
+	assert.Nil(t, ParseFieldList(""))
+}
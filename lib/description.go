@@ -21,15 +21,30 @@ func NewDescriptionFromReader(r io.Reader) (*Description, error) {
 	if err := json.NewDecoder(r).Decode(&d.schemas); err != nil {
 		return nil, err
 	}
+
+	for _, collectionMap := range d.schemas {
+		for collectionName, collection := range collectionMap {
+			if collection == nil {
+				collection = &Collection{}
+				collectionMap[collectionName] = collection
+			}
+			collection.init(collectionName)
+			if err := collection.validate(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	return d, nil
 }
 
-func (d *Description) AddCollection(collectionName string, dbName string) {
+func (d *Description) AddCollection(collectionName string, dbName string) *Collection {
 	if _, ok := d.schemas[dbName]; !ok {
 		d.schemas[dbName] = map[string]*Collection{}
 	}
 	d.schemas[dbName][collectionName] = &Collection{}
 	d.schemas[dbName][collectionName].Fields = make(map[string]*Field)
+	return d.schemas[dbName][collectionName]
 }
 
 func (d *Description) Save(w io.Writer) error {
@@ -1,11 +1,17 @@
 package mongodb
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/segmentio/objects-go"
 	"github.com/tj/go-sync/semaphore"
+	"gopkg.in/mgo.v2/bson"
 )
 
 type SetObjectFunc func(o *objects.Object)
@@ -36,6 +42,17 @@ func InitSchema(config *Config, fileName string) {
 		return
 	}
 
+	// Preview where each collection will be exported, given the naming policy.
+	if err := app.ResolveDestinationNames(description); err != nil {
+		logrus.WithError(err).Warn("Destination names collide, set `destination_name` for these collections")
+	}
+	for collection := range description.Iter() {
+		logrus.WithFields(logrus.Fields{
+			"collection":  collection.CollectionName,
+			"destination": app.destinationName(collection),
+		}).Info("Destination preview")
+	}
+
 	if err := description.Save(schemaFile); err != nil {
 		logrus.WithError(err).WithField("schema_file", schemaFile).Error("Failed to save schema file")
 		return
@@ -56,7 +73,61 @@ func ParseSchema(fileName string) (*Description, error) {
 	return NewDescriptionFromReader(schemaFile)
 }
 
-func Run(config *Config, description *Description, concurrency int, setObjectFunc SetObjectFunc) error {
+// Publisher delivers the objects of a run, e.g. a Sink or an objects-go client.
+type Publisher interface {
+	Set(o *objects.Object) error
+	Close() error
+}
+
+// Publishers reporting the outcome of their deliveries, such as Sink.
+type deliveryReporter interface {
+	Deliveries() map[string]*DeliveryReport
+}
+
+// Run scans the collections of the description and publishes their objects. The publisher is
+// closed at the end of the run, so that the run fails if any object could not be delivered, as it
+// does if any collection could not be scanned.
+func Run(config *Config, description *Description, concurrency int, publisher Publisher) (err error) {
+	report := NewReport(config.Database)
+	// States of the scanned collections, saved once their objects are delivered.
+	var store *StateStore
+	var statesMu sync.Mutex
+	var states []*pendingState
+	defer func() {
+		// Objects still buffered are delivered before the outcome of the run is known.
+		publisher.Close()
+		var deliveries map[string]*DeliveryReport
+		if r, ok := publisher.(deliveryReporter); ok {
+			deliveries = r.Deliveries()
+			report.recordDeliveries(deliveries)
+		}
+		if store != nil {
+			savePendingStates(store, config.Database, states, deliveries, report)
+		}
+		if err != nil {
+			report.recordError(err)
+		} else {
+			err = report.err()
+		}
+
+		report.Finish()
+		if b, err := report.MarshalJSON(); err == nil {
+			logrus.WithField("report", string(b)).Info("Run report")
+		}
+		if config.ReportPath == "" {
+			return
+		}
+		if err := report.Save(config.ReportPath); err != nil {
+			logrus.WithError(err).Error("Unable to save run report")
+		}
+	}()
+
+	setObjectFunc := func(o *objects.Object) {
+		if err := publisher.Set(o); err != nil {
+			logrus.WithFields(logrus.Fields{"id": o.ID, "collection": o.Collection, "properties": o.Properties}).Warn(err)
+		}
+	}
+
 	app := &MongoDB{}
 	defer app.Close()
 
@@ -68,21 +139,117 @@ func Run(config *Config, description *Description, concurrency int, setObjectFun
 		return err
 	}
 
+	if err := app.ResolveDestinationNames(description); err != nil {
+		logrus.Error(err)
+		return err
+	}
+
+	// The scan strategy depends on the kind of each collection.
+	if err := app.ClassifyCollections(description); err != nil {
+		logrus.WithError(err).Warn("Unable to list collections, using the kinds of the schema")
+	}
+
+	if config.Sink != nil {
+		report.recordSink(config.Sink)
+	}
+
+	// Reads from secondaries are kept on members that do not lag too much behind the primary.
+	if config.Secondary && config.MaxLag > 0 {
+		app.guard = newLagGuard(app.dialInfo, config.MaxLag, config.MaxLagWait, report)
+		stop := make(chan struct{})
+		defer close(stop)
+		go app.guard.monitor(app, stop)
+	}
+
+	// All collections are read with the same read concern, at the same cluster time for snapshots.
+	if err := app.pinReadConcern(config.ReadConcern, report); err != nil {
+		logrus.Error(err)
+		return err
+	}
+	if report.ClusterTime != nil {
+		var collections []*Collection
+		for collection := range description.Iter() {
+			if collection.scanned() {
+				collections = append(collections, collection)
+			}
+		}
+		if err := app.checkSnapshotWindow(collections, concurrency, config.RateLimit); err != nil {
+			logrus.Error(err)
+			return err
+		}
+	}
+
+	// Changes are streamed from the position of the oplog before the scans, so that none is missed.
+	// With a snapshot, the scans read the database as of that position exactly. Otherwise they must
+	// read a member at least as recent as the one the position is taken from, which secondaries that
+	// lag behind it are not.
+	publish := setObjectFunc
+	var from bson.MongoTimestamp
+	var exported *exportedObjects
+	if config.Stream {
+		if report.ClusterTime != nil {
+			from = report.ClusterTime.mongo()
+		} else {
+			if config.Secondary {
+				err := errors.New("streaming from secondaries requires snapshot read concern, so that the scans read the position the stream starts from")
+				logrus.Error(err)
+				return err
+			}
+			var err error
+			if from, err = app.oplogPosition(); err != nil {
+				logrus.Error(err)
+				return err
+			}
+		}
+		report.recordStreamFrom(newTimestamp(from))
+		exported = newExportedObjects()
+		setObjectFunc = func(o *objects.Object) {
+			exported.changed(o)
+			publish(o)
+		}
+	}
+
+	// All collections share the same read rate, which follows the load of the server in adaptive
+	// mode.
+	app.limiter = newRateLimiter(config.RateLimit)
+	if app.limiter != nil && config.RateLimit.Adaptive {
+		stop := make(chan struct{})
+		defer close(stop)
+		go app.adaptRate(app.limiter, stop)
+	}
+
+	// Both deleted documents and unchanged documents are found by comparing what is scanned now
+	// against the state saved by the previous run.
+	if config.DetectDeletes || config.SkipUnchanged {
+		var err error
+		if store, err = NewStateStore(config.StateDir); err != nil {
+			logrus.Error(err)
+			return err
+		}
+	}
+
 	// Launch goroutines to scan the documents in each collection.
 	sem := make(semaphore.Semaphore, concurrency)
 
+	var scanned []*Collection
 	for collection := range description.Iter() {
-		// Skip collection if no fields specified in schema JSON.
-		if len(collection.Fields) == 0 {
+		if !collection.scanned() {
 			continue
 		}
+		scanned = append(scanned, collection)
 
 		sem.Acquire()
 		go func(collection *Collection, dbName string) {
 			defer sem.Release()
 			logrus.WithFields(logrus.Fields{"db": dbName, "collection": collection.CollectionName}).Info("Scan started")
-			if err := app.ScanCollection(collection, setObjectFunc); err != nil {
+			state, err := syncCollection(app, config, store, collection, setObjectFunc)
+			if err != nil {
 				logrus.Error(err)
+				report.recordError(fmt.Errorf("collection %q: %v", collection.CollectionName, err))
+			} else if state != nil {
+				statesMu.Lock()
+				states = append(states, state)
+				statesMu.Unlock()
 			}
 			logrus.WithFields(logrus.Fields{"db": dbName, "collection": collection.CollectionName}).Info("Scan finished")
 		}(collection, app.DBName)
@@ -94,5 +261,104 @@ func Run(config *Config, description *Description, concurrency int, setObjectFun
 	for collection := range description.Iter() {
 		logrus.WithFields(logrus.Fields{"db": app.DBName, "collection": collection.CollectionName}).Info("Sync finished")
 	}
+
+	if config.Stream {
+		stop := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(signals)
+		go func() {
+			<-signals
+			logrus.Info("Stopping the stream")
+			close(stop)
+		}()
+
+		if err := app.stream(scanned, from, exported, publish, report, stop); err != nil {
+			logrus.Error(err)
+			return err
+		}
+	}
 	return nil
 }
+
+// Scans a single collection. When a state store is given, the content hash of every document is
+// recorded so that unchanged documents can be skipped and deleted ones detected next time. The
+// state is returned to be saved once the objects of the scan are delivered, so a failed scan or
+// delivery is simply retried from the previous state on the next run.
+func syncCollection(app *MongoDB, config *Config, store *StateStore, collection *Collection, setObjectFunc SetObjectFunc) (*pendingState, error) {
+	if store == nil {
+		return nil, app.ScanCollection(collection, setObjectFunc)
+	}
+
+	previous, err := store.Load(app.DBName, collection.CollectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	current := NewCollectionState()
+	skipped := 0
+	publish := func(o *objects.Object) {
+		hash, err := hashProperties(o.Properties)
+		if err != nil {
+			logrus.WithError(err).WithField("id", o.ID).Warn("Unable to hash document, publishing it anyway")
+		}
+		current.SetHash(o, hash)
+
+		if config.SkipUnchanged && !config.ForceFull && hash != "" && previous.Hash(o) == hash {
+			skipped++
+			return
+		}
+		setObjectFunc(o)
+	}
+
+	if err := app.ScanCollection(collection, publish); err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"collection": collection.CollectionName,
+		"unchanged":  skipped,
+	}).Info("Unchanged documents skipped")
+
+	if config.DetectDeletes {
+		app.PublishDeletes(collection, previous, current, setObjectFunc)
+	}
+
+	// Tombstones are published to the destinations of the previous state.
+	destinations := make(map[string]bool)
+	for _, state := range []*CollectionState{previous, current} {
+		for destination := range state.Objects {
+			destinations[destination] = true
+		}
+	}
+	return &pendingState{collection: collection.CollectionName, state: current, destinations: destinations}, nil
+}
+
+// State of a scanned collection waiting for the objects it was published as to be delivered.
+type pendingState struct {
+	collection string
+	state      *CollectionState
+	// Destinations objects of the collection were published to.
+	destinations map[string]bool
+}
+
+// Saves the states of the collections none of whose objects failed to be delivered. The others keep
+// their previous state, so that their objects are not skipped as unchanged by the next run. Without
+// deliveries, i.e. from a publisher that does not report them, every state is saved.
+func savePendingStates(store *StateStore, dbName string, states []*pendingState, deliveries map[string]*DeliveryReport, report *Report) {
+	for _, pending := range states {
+		delivered := true
+		for destination := range pending.destinations {
+			if d, ok := deliveries[destination]; ok && d.Failed > 0 {
+				delivered = false
+			}
+		}
+		if !delivered {
+			logrus.WithField("collection", pending.collection).Warn("Some objects were not delivered, keeping the previous state")
+			continue
+		}
+		if err := store.Save(dbName, pending.collection, pending.state); err != nil {
+			logrus.Error(err)
+			report.recordError(fmt.Errorf("collection %q: %v", pending.collection, err))
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package mongodb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Kinds of collections, as reported by `listCollections`. Regular collections have no kind.
+const (
+	// KindView is a read-only view, which is scanned with an aggregation so that the pipeline of
+	// the view may use disk.
+	KindView = "view"
+	// KindCapped is a capped collection, which is scanned in insertion order so that documents
+	// overwritten during the scan do not shift the cursor.
+	KindCapped = "capped"
+	// KindTimeSeries is a time-series collection, which is scanned in the order of its time field
+	// matching the way its buckets are stored, if an index on the time field allows it.
+	KindTimeSeries = "timeseries"
+)
+
+// Prefix of the collections Mongo uses internally, e.g. `system.views` or `system.profile`.
+const systemPrefix = "system."
+
+// Metadata of a collection returned by `listCollections`.
+type collectionInfo struct {
+	Name    string `bson:"name"`
+	Type    string `bson:"type"`
+	Options struct {
+		Capped     bool   `bson:"capped"`
+		ViewOn     string `bson:"viewOn"`
+		TimeSeries *struct {
+			TimeField string `bson:"timeField"`
+		} `bson:"timeseries"`
+	} `bson:"options"`
+}
+
+func (info *collectionInfo) kind() string {
+	switch {
+	case info.Type == "view":
+		return KindView
+	case info.Type == "timeseries" || info.Options.TimeSeries != nil:
+		return KindTimeSeries
+	case info.Options.Capped:
+		return KindCapped
+	}
+	return ""
+}
+
+func (info *collectionInfo) timeField() string {
+	if info.Options.TimeSeries == nil {
+		return ""
+	}
+	return info.Options.TimeSeries.TimeField
+}
+
+func validKind(kind string) bool {
+	switch kind {
+	case "", KindView, KindCapped, KindTimeSeries:
+		return true
+	}
+	return false
+}
+
+func isSystemCollection(name string) bool {
+	return strings.HasPrefix(name, systemPrefix)
+}
+
+// Lists the collections of the database along with their metadata, sorted by name. Servers too old
+// to support `listCollections` only report names, all their collections are then taken as regular
+// ones.
+func (m *MongoDB) listCollections() ([]*collectionInfo, error) {
+	var result struct {
+		Cursor struct {
+			FirstBatch []bson.Raw `bson:"firstBatch"`
+			NS         string     `bson:"ns"`
+			ID         int64      `bson:"id"`
+		} `bson:"cursor"`
+	}
+	if err := m.db.Run(bson.D{{Name: "listCollections", Value: 1}}, &result); err != nil {
+		logrus.WithError(err).Debug("listCollections failed, falling back to collection names")
+		return m.listCollectionNames()
+	}
+
+	var iter *mgo.Iter
+	if ns := strings.SplitN(result.Cursor.NS, ".", 2); len(ns) == 2 {
+		iter = m.db.Session.DB(ns[0]).C(ns[1]).NewIter(nil, result.Cursor.FirstBatch, result.Cursor.ID, nil)
+	} else {
+		iter = m.db.C("").NewIter(nil, result.Cursor.FirstBatch, result.Cursor.ID, nil)
+	}
+	var infos []*collectionInfo
+	for {
+		info := &collectionInfo{}
+		if !iter.Next(info) {
+			break
+		}
+		infos = append(infos, info)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(byCollectionName(infos))
+	return infos, nil
+}
+
+type byCollectionName []*collectionInfo
+
+func (s byCollectionName) Len() int           { return len(s) }
+func (s byCollectionName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byCollectionName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+func (m *MongoDB) listCollectionNames() ([]*collectionInfo, error) {
+	names, err := m.db.CollectionNames()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*collectionInfo, 0, len(names))
+	for _, name := range names {
+		infos = append(infos, &collectionInfo{Name: name})
+	}
+	return infos, nil
+}
+
+// ClassifyCollections sets the kind of the collections of the description from what the server
+// reports, which may have changed since the schema was generated. Collections missing from the
+// server keep the kind of the schema.
+func (m *MongoDB) ClassifyCollections(d *Description) error {
+	infos, err := m.listCollections()
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]*collectionInfo, len(infos))
+	for _, info := range infos {
+		byName[info.Name] = info
+	}
+
+	for collection := range d.Iter() {
+		if collection.IsVirtual() {
+			continue
+		}
+		info, ok := byName[collection.CollectionName]
+		if !ok {
+			logrus.WithField("collection", collection.CollectionName).Warn("Collection not found in database")
+			continue
+		}
+		if kind := info.kind(); kind != collection.Kind {
+			logrus.WithFields(logrus.Fields{
+				"collection": collection.CollectionName,
+				"schema":     collection.Kind,
+				"database":   kind,
+			}).Info("Kind of collection changed since the schema was generated")
+			collection.Kind = kind
+		}
+		collection.timeField = ""
+		if timeField := info.timeField(); timeField != "" {
+			if m.hasIndexOn(collection.CollectionName, timeField) {
+				collection.timeField = timeField
+			} else {
+				logrus.WithFields(logrus.Fields{
+					"collection": collection.CollectionName,
+					"timeField":  timeField,
+				}).Info("No index on the time field, scanning the time series in natural order")
+			}
+		}
+	}
+	return nil
+}
+
+// Reports whether an index of the collection can sort its documents by a field, i.e. starts with
+// it in either order. Sorting otherwise happens in memory, which fails on large collections.
+func (m *MongoDB) hasIndexOn(collectionName, field string) bool {
+	indexes, err := m.db.C(collectionName).Indexes()
+	if err != nil {
+		logrus.WithError(err).WithField("collection", collectionName).Debug("Unable to list indexes")
+		return false
+	}
+	return indexSorts(indexes, field)
+}
+
+func indexSorts(indexes []mgo.Index, field string) bool {
+	for _, index := range indexes {
+		if len(index.Key) > 0 && strings.TrimPrefix(index.Key[0], "-") == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Describes the kind of a collection for logs.
+func describeKind(info *collectionInfo) string {
+	switch info.kind() {
+	case KindView:
+		return fmt.Sprintf("view on %q", info.Options.ViewOn)
+	case KindTimeSeries:
+		return fmt.Sprintf("time-series on %q", info.timeField())
+	case KindCapped:
+		return "capped collection"
+	}
+	return "collection"
+}
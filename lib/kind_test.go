@@ -0,0 +1,59 @@
+package mongodb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCollectionInfoKind(t *testing.T) {
+	for _, test := range []struct {
+		doc       bson.M
+		kind      string
+		timeField string
+	}{
+		{bson.M{"name": "users", "type": "collection", "options": bson.M{}}, "", ""},
+		{bson.M{"name": "users"}, "", ""},
+		{bson.M{"name": "active_users", "type": "view", "options": bson.M{"viewOn": "users", "pipeline": []bson.M{}}}, KindView, ""},
+		{bson.M{"name": "logs", "type": "collection", "options": bson.M{"capped": true, "size": 4096}}, KindCapped, ""},
+		{bson.M{"name": "metrics", "type": "timeseries", "options": bson.M{"timeseries": bson.M{"timeField": "ts", "metaField": "host"}}}, KindTimeSeries, "ts"},
+	} {
+		b, err := bson.Marshal(test.doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := &collectionInfo{}
+		if err := bson.Unmarshal(b, info); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, test.kind, info.kind())
+		assert.Equal(t, test.timeField, info.timeField())
+	}
+}
+
+func TestIndexSorts(t *testing.T) {
+	indexes := []mgo.Index{{Key: []string{"_id"}}, {Key: []string{"host", "ts"}}}
+	assert.False(t, indexSorts(indexes, "ts"), "the time field is not the first key")
+	assert.False(t, indexSorts(nil, "ts"))
+
+	indexes = append(indexes, mgo.Index{Key: []string{"-ts", "host"}})
+	assert.True(t, indexSorts(indexes, "ts"))
+}
+
+func TestIsSystemCollection(t *testing.T) {
+	assert.True(t, isSystemCollection("system.views"))
+	assert.True(t, isSystemCollection("system.profile"))
+	assert.False(t, isSystemCollection("systems"))
+	assert.False(t, isSystemCollection("users"))
+}
+
+func TestParseSchemaKind(t *testing.T) {
+	desc, err := NewDescriptionFromReader(strings.NewReader(`{"test": {"logs": {"kind": "capped", "fields": {"msg": null}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, KindCapped, desc.schemas["test"]["logs"].Kind)
+}
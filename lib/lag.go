@@ -0,0 +1,227 @@
+package mongodb
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+)
+
+// How often the replication lag of the members is checked while reading from secondaries.
+const lagCheckInterval = 10 * time.Second
+
+// Keeps reads on secondaries that lag behind the primary by no more than the maximum lag. Each
+// collection scan picks the least lagging eligible secondary, preferring the one already in use, and
+// reads from it directly. A scan whose secondary lags too much goes on from another eligible one,
+// if any. Otherwise its reads are paused while that secondary lags too much, or while its lag is
+// unknown because there is no primary, and fail once no secondary caught up within the time
+// allowed.
+type lagGuard struct {
+	info    mgo.DialInfo
+	maxLag  time.Duration
+	maxWait time.Duration
+	report  *Report
+
+	mu       sync.Mutex
+	members  []replicaSetMember
+	sessions map[string]*mgo.Session
+	current  string
+}
+
+func newLagGuard(info mgo.DialInfo, maxLag, maxWait time.Duration, report *Report) *lagGuard {
+	return &lagGuard{
+		info:     info,
+		maxLag:   maxLag,
+		maxWait:  maxWait,
+		report:   report,
+		sessions: make(map[string]*mgo.Session),
+	}
+}
+
+// Refreshes the status of the members of the replica set and records their lag.
+func (g *lagGuard) refresh(m *MongoDB) error {
+	members, err := m.replicaSetMembers()
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if l, known := lag(members, member); known && member.State == stateSecondary {
+			g.report.recordLag(member.Name, l)
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.members = members
+	return nil
+}
+
+// Returns the secondaries within the maximum lag, least lagging first.
+func (g *lagGuard) eligible() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return eligibleMembers(g.members, g.maxLag)
+}
+
+func eligibleMembers(members []replicaSetMember, maxLag time.Duration) []string {
+	var eligible []memberLag
+	for _, member := range members {
+		if l, known := lag(members, member); known && member.State == stateSecondary && l <= maxLag {
+			eligible = append(eligible, memberLag{member.Name, l})
+		}
+	}
+	sort.Stable(byLag(eligible))
+
+	names := make([]string, len(eligible))
+	for i, member := range eligible {
+		names[i] = member.name
+	}
+	return names
+}
+
+type memberLag struct {
+	name string
+	lag  time.Duration
+}
+
+type byLag []memberLag
+
+func (s byLag) Len() int           { return len(s) }
+func (s byLag) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLag) Less(i, j int) bool { return s[i].lag < s[j].lag }
+
+// Returns the lag of a member as of the last refresh, and false if it cannot be read from anymore,
+// e.g. it is recovering, or its lag is unknown. A secondary elected primary does not lag at all.
+func (g *lagGuard) lag(name string) (time.Duration, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, member := range g.members {
+		if member.Name == name {
+			l, known := lag(g.members, member)
+			return l, known && (member.State == stateSecondary || member.State == statePrimary)
+		}
+	}
+	return 0, false
+}
+
+// Returns the database on an eligible secondary to scan a collection from, waiting for one to
+// catch up if none is eligible.
+func (g *lagGuard) acquire(m *MongoDB) (*mgo.Database, string, error) {
+	start := time.Now()
+	for {
+		if err := g.refresh(m); err != nil {
+			return nil, "", err
+		}
+
+		eligible := g.eligible()
+		if len(eligible) > 0 {
+			return g.database(m.DBName, eligible)
+		}
+		if time.Since(start) >= g.maxWait {
+			return nil, "", fmt.Errorf("no secondary lags less than %v behind the primary", g.maxLag)
+		}
+		logrus.WithField("max_lag", g.maxLag).Warn("No secondary within the maximum lag, waiting")
+		time.Sleep(lagCheckInterval)
+	}
+}
+
+// Returns the database on the member in use if it is eligible, on the first eligible one otherwise.
+func (g *lagGuard) database(dbName string, eligible []string) (*mgo.Database, string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	member := eligible[0]
+	for _, name := range eligible {
+		if name == g.current {
+			member = name
+		}
+	}
+	if member != g.current {
+		logrus.WithFields(logrus.Fields{"from": g.current, "to": member}).Info("Switching secondary")
+		g.current = member
+	}
+
+	session, ok := g.sessions[member]
+	if !ok {
+		info := g.info
+		info.Addrs = []string{member}
+		info.Direct = true
+		var err error
+		if session, err = mgo.DialWithInfo(&info); err != nil {
+			return nil, "", err
+		}
+		session.SetMode(mgo.Monotonic, true)
+		g.sessions[member] = session
+	}
+	return session.DB(dbName), member, nil
+}
+
+// Returned by lagGuard.wait when the member lags too much while another one is eligible, so that
+// the scan goes on from the other member.
+var errSecondaryLags = errors.New("secondary lags too much, switching to another one")
+
+// Waits while the member lags too much, until the time allowed elapsed. Fails with errSecondaryLags
+// right away if another member is eligible.
+func (g *lagGuard) wait(member string) error {
+	if g == nil {
+		return nil
+	}
+
+	var start time.Time
+	for {
+		lag, ok := g.lag(member)
+		if ok && lag <= g.maxLag {
+			return nil
+		}
+		for _, name := range g.eligible() {
+			if name != member {
+				logrus.WithFields(logrus.Fields{"member": member, "lag": lag, "to": name}).Warn("Secondary lags too much, switching to another one")
+				return errSecondaryLags
+			}
+		}
+		if start.IsZero() {
+			start = time.Now()
+			g.report.recordPause(member)
+			if ok {
+				logrus.WithFields(logrus.Fields{"member": member, "lag": lag}).Warn("Secondary lags too much, pausing reads")
+			} else {
+				logrus.WithField("member", member).Warn("Lag of the secondary is unknown, e.g. there is no primary, pausing reads")
+			}
+		}
+		if time.Since(start) >= g.maxWait {
+			if !ok {
+				return fmt.Errorf("lag of secondary %q is still unknown", member)
+			}
+			return fmt.Errorf("secondary %q still lags %v behind the primary", member, lag)
+		}
+		time.Sleep(lagCheckInterval)
+	}
+}
+
+// Refreshes the status of the members periodically until stop is closed.
+func (g *lagGuard) monitor(m *MongoDB, stop <-chan struct{}) {
+	ticker := time.NewTicker(lagCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := g.refresh(m); err != nil {
+			logrus.WithError(err).Warn("Unable to check the replication lag")
+		}
+	}
+}
+
+func (g *lagGuard) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, session := range g.sessions {
+		session.Close()
+	}
+}
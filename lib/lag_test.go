@@ -0,0 +1,80 @@
+package mongodb
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2"
+)
+
+func TestEligibleMembers(t *testing.T) {
+	now := time.Now()
+	members := []replicaSetMember{
+		{Name: "a:27017", State: stateSecondary, OptimeDate: now.Add(-30 * time.Second)},
+		{Name: "b:27017", State: statePrimary, OptimeDate: now},
+		{Name: "c:27017", State: stateSecondary, OptimeDate: now.Add(-2 * time.Second)},
+		{Name: "d:27017", State: stateSecondary, OptimeDate: now},
+		{Name: "e:27017", State: 3, OptimeDate: now},
+	}
+	assert.Equal(t, []string{"d:27017", "c:27017"}, eligibleMembers(members, 5*time.Second))
+	assert.Equal(t, []string{"d:27017", "c:27017", "a:27017"}, eligibleMembers(members, time.Minute))
+	assert.Empty(t, eligibleMembers(members[:2], 5*time.Second))
+}
+
+func TestLagGuardWait(t *testing.T) {
+	now := time.Now()
+	g := newLagGuard(mgo.DialInfo{}, 5*time.Second, 0, NewReport("test"))
+	g.members = []replicaSetMember{
+		{Name: "a:27017", State: stateSecondary, OptimeDate: now.Add(-30 * time.Second)},
+		{Name: "b:27017", State: statePrimary, OptimeDate: now},
+		{Name: "c:27017", State: stateSecondary, OptimeDate: now.Add(-time.Second)},
+	}
+
+	assert.NoError(t, g.wait("c:27017"))
+	assert.NoError(t, g.wait("b:27017"))
+	// A lagging member is left for another eligible one, without pausing.
+	assert.Equal(t, errSecondaryLags, g.wait("a:27017"))
+	assert.Equal(t, errSecondaryLags, g.wait("z:27017"))
+	assert.True(t, isRetryable(errSecondaryLags))
+	assert.Nil(t, g.report.ReplicationLag["a:27017"])
+
+	// Without another eligible member, nor time allowed for catching up, it fails right away.
+	g.members = g.members[:2]
+	assert.Error(t, g.wait("a:27017"))
+	assert.NotEqual(t, errSecondaryLags, g.wait("a:27017"))
+	assert.Equal(t, 2, g.report.ReplicationLag["a:27017"].Pauses)
+
+	// Without a primary, e.g. during an election, the lag of secondaries is unknown.
+	g.members = []replicaSetMember{
+		{Name: "a:27017", State: stateSecondary, OptimeDate: now.Add(-30 * time.Second)},
+		{Name: "c:27017", State: stateSecondary, OptimeDate: now},
+	}
+	assert.Error(t, g.wait("c:27017"))
+	assert.Empty(t, g.eligible())
+
+	// A nil guard never waits.
+	assert.NoError(t, (*lagGuard)(nil).wait("a:27017"))
+}
+
+func TestReportLag(t *testing.T) {
+	r := NewReport("test")
+	r.recordLag("a:27017", 3*time.Second)
+	r.recordLag("a:27017", time.Second)
+	r.recordPause("a:27017")
+	r.Finish()
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "test", decoded["database"])
+	assert.Equal(t, map[string]interface{}{
+		"a:27017": map[string]interface{}{"max_seconds": 3.0, "last_seconds": 1.0, "pauses": 1.0},
+	}, decoded["replication_lag"])
+}
@@ -4,11 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/segmentio/go-snakecase"
 	"github.com/segmentio/objects-go"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -20,19 +20,34 @@ var (
 )
 
 type MongoDB struct {
-	db     *mgo.Database
-	DBName string
+	db            *mgo.Database
+	DBName        string
+	naming        *NamingPolicy
+	includeSystem bool
+	shardParallel bool
+	cursor        *CursorOptions
+	// Time allowed for retries of a failed cursor, 0 to fail right away.
+	retryMaxElapsed time.Duration
+	// Limits the rate of reads across all collections, nil for no limit.
+	limiter *rateLimiter
+	// Keeps reads on secondaries that do not lag too much, nil to read from any member.
+	guard *lagGuard
+	// Used to dial members of the replica set directly.
+	dialInfo mgo.DialInfo
+	// Read concern of all the reads of a run, nil for the default of the server.
+	readConcern bson.D
 }
 
 func (m *MongoDB) Init(c *Config) error {
-	session, err := mgo.DialWithInfo(&mgo.DialInfo{
+	m.dialInfo = mgo.DialInfo{
 		Addrs:    []string{c.Hostname + ":" + c.Port},
 		Direct:   c.Direct,
 		Database: c.Database,
 		Username: c.Username,
 		Password: c.Password,
 		Timeout:  time.Duration(5 * time.Second),
-	})
+	}
+	session, err := mgo.DialWithInfo(&m.dialInfo)
 	if err != nil {
 		return err
 	}
@@ -67,6 +82,14 @@ func (m *MongoDB) Init(c *Config) error {
 
 	m.db = session.DB(c.Database)
 	m.DBName = c.Database
+	m.naming = c.Naming
+	if m.naming == nil {
+		m.naming = NewNamingPolicy()
+	}
+	m.includeSystem = c.IncludeSystem
+	m.shardParallel = c.ShardParallel
+	m.cursor = c.Cursor
+	m.retryMaxElapsed = c.RetryMaxElapsed
 	logrus.Infof("Connection to database '%s' established!", c.Database)
 	return nil
 }
@@ -74,64 +97,280 @@ func (m *MongoDB) Init(c *Config) error {
 func (m *MongoDB) GetDescription() (*Description, error) {
 	desc := NewDescription()
 
-	names, err := m.db.CollectionNames()
+	infos, err := m.listCollections()
 	if err != nil {
 		return nil, err
 	}
 
-	for _, name := range names {
+	for _, info := range infos {
+		if isSystemCollection(info.Name) && !m.includeSystem {
+			logrus.WithField("collection", info.Name).Debug("Skipping system collection")
+			continue
+		}
+		logrus.WithField("collection", info.Name).Infof("Found %s", describeKind(info))
+
 		// Add collections to result (it is intentionally empty right now so user can fill them out after init stage).
-		desc.AddCollection(name, m.DBName)
+		desc.AddCollection(info.Name, m.DBName).Kind = info.kind()
 	}
 
 	return desc, nil
 }
 
 func (m *MongoDB) ScanCollection(c *Collection, publish func(o *objects.Object)) error {
-	fieldsToInclude := make(map[string]interface{})
-	for source := range c.Fields {
-		fieldsToInclude[source] = 1
-	}
+	fieldsToInclude := c.projection()
 	logrus.WithFields(logrus.Fields{"fieldsToInclude": fieldsToInclude}).Debug("Calculating which fields to include or exclude.")
 
+	// Secondaries lagging too much are not read from. A cursor opened again after a failure reads
+	// from the member eligible then, which is another one if the member in use is gone or lags.
+	db, throttle, err := m.connect()
+	if err != nil {
+		return err
+	}
+	connect := func(retry bool) (*mgo.Database, func(size int) error, error) {
+		if retry {
+			return m.connect()
+		}
+		return db, throttle, nil
+	}
+	opts := m.cursor.merge(c.Cursor)
+
+	// Reading documents in `_id` order is only needed to resume failed cursors.
+	resumable := m.retryMaxElapsed > 0 && c.resumable(opts)
+
+	// Sharded collections may be scanned one cursor per shard instead of a single one.
+	if m.shardParallel && !c.IsVirtual() && c.Kind != KindView {
+		key, chunks, err := m.shardChunks(c)
+		if err != nil {
+			logrus.WithError(err).WithField("collection", c.CollectionName).Warn("Unable to read chunks, scanning through a single cursor")
+		} else if len(chunks) > 0 {
+			logrus.WithFields(logrus.Fields{"collection": c.CollectionName, "shards": len(chunks)}).Info("Scanning shards in parallel")
+			if err := m.scanShards(c, opts, resumable, key, chunks, fieldsToInclude, connect, publish); err != nil {
+				return err
+			}
+			c.reportCastFailures()
+			return nil
+		}
+	}
+
 	// Iterate through collection, grabbing only user specified fields.
-	iter := m.db.C(c.CollectionName).Find(nil).Select(fieldsToInclude).Iter()
-	var result map[string]interface{}
-	for iter.Next(&result) {
-		logrus.WithFields(logrus.Fields{
-			"result":     result,
-			"Collection": c.CollectionName,
-		}).Debug("Processing row from DB")
-
-		id, err := getIdFromResult(result)
+	var open func(db *mgo.Database, after interface{}) *mgo.Iter
+	switch {
+	case c.IsVirtual():
+		open = func(db *mgo.Database, after interface{}) *mgo.Iter {
+			return m.openPipe(db, c.Source, c.aggregation(fieldsToInclude), opts)
+		}
+	case c.Kind == KindView:
+		// Views are aggregations too, running one over the view lets its pipeline use disk.
+		open = func(db *mgo.Database, after interface{}) *mgo.Iter {
+			return m.openPipe(db, c.CollectionName, c.aggregation(fieldsToInclude), opts)
+		}
+	default:
+		open = func(db *mgo.Database, after interface{}) *mgo.Iter {
+			return m.openFind(db, c, opts, resumeFilter(nil, after), fieldsToInclude, resumable)
+		}
+	}
+	if _, err := m.scanWithRecovery(c, opts, resumable, connect, open, publish); err != nil {
+		return err
+	}
+
+	c.reportCastFailures()
+	return nil
+}
+
+// Returns the database to scan a collection from, on an eligible secondary if reads are guarded
+// against replication lag, and the throttle of the reads from it.
+func (m *MongoDB) connect() (*mgo.Database, func(size int) error, error) {
+	db, member := m.db, ""
+	if m.guard != nil {
+		var err error
+		if db, member, err = m.guard.acquire(m); err != nil {
+			return nil, nil, err
+		}
+	}
+	throttle := func(size int) error {
+		m.limiter.wait(size)
+		return m.guard.wait(member)
+	}
+	return db, throttle, nil
+}
+
+// Returns the query reading the documents of a collection matching the filter, in `_id` order if
+// byID is set.
+func find(db *mgo.Database, c *Collection, opts *CursorOptions, filter bson.M, fieldsToInclude map[string]interface{}, byID bool) *mgo.Query {
+	query := db.C(c.CollectionName).Find(filter)
+	if fieldsToInclude != nil {
+		query = query.Select(fieldsToInclude)
+	}
+	if sort := sortFields(c, opts, byID); len(sort) > 0 {
+		query = query.Sort(sort...)
+	}
+	return opts.apply(query)
+}
+
+// Publishes the documents of a cursor and closes it, recording the progress made. Reading each
+// document is subject to throttle, given the size of the document.
+func (m *MongoDB) scanIter(c *Collection, iter *mgo.Iter, throttle func(size int) error, publish func(o *objects.Object), progress *cursorProgress) error {
+	// Documents are processed in batches when they refer to other documents, so that the referenced
+	// documents can be fetched together.
+	batchSize := 1
+	if c.hasReferences() {
+		batchSize = referenceBatchSize
+	}
+	batch := make([]map[string]interface{}, 0, batchSize)
+	flush := func() error {
+		defer func() { batch = batch[:0] }()
+		release, err := m.resolveReferences(c, batch)
 		if err != nil {
 			return err
 		}
+		defer release()
+		for _, result := range batch {
+			if err := m.publishResult(c, result, publish); err != nil {
+				return err
+			}
+			progress.documents++
+			progress.lastID = result["_id"]
+		}
+		return nil
+	}
 
-		// The destination name (e.g. name of the collection in the warehouse) can be set by the user,
-		// otherwise it just defaults to the collection name in Mongo.
-		var destinationName string
-		if c.DestinationName == "" {
-			destinationName = snakecase.Snakecase(fmt.Sprintf("%s_%s", m.DBName, c.CollectionName))
-		} else {
-			destinationName = c.DestinationName
+	for {
+		// Documents are read raw first to account for their size, then each is decoded in a new map
+		// since they are kept until their batch is processed.
+		var raw bson.Raw
+		if !iter.Next(&raw) {
+			break
+		}
+		if err := throttle(len(raw.Data)); err != nil {
+			iter.Close()
+			return err
 		}
+		var result map[string]interface{}
+		if err := raw.Unmarshal(&result); err != nil {
+			iter.Close()
+			return err
+		}
+		batch = append(batch, result)
+		if len(batch) < batchSize {
+			continue
+		}
+		if err := flush(); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	// Documents read before the cursor failed are published, so that a resumed scan does not read
+	// them again.
+	if err := flush(); err != nil {
+		iter.Close()
+		return err
+	}
 
-		// Create properties map and fill it in with all the fields were able to find.
-		properties := getPropertiesMapFromResult(result, c)
+	return iter.Close()
+}
 
-		publish(&objects.Object{
-			ID:         id,
-			Collection: destinationName,
-			Properties: properties,
-		})
-		logrus.WithFields(logrus.Fields{"ID": id, "Collection": destinationName, "Properties": properties}).Debug("Published row")
+// Publishes the object of a document along with all the objects extracted from it.
+func (m *MongoDB) publishResult(c *Collection, result map[string]interface{}, publish func(o *objects.Object)) error {
+	logrus.WithFields(logrus.Fields{
+		"result":     result,
+		"Collection": c.CollectionName,
+	}).Debug("Processing row from DB")
+
+	id, err := getIdFromResult(result)
+	if err != nil {
+		return err
 	}
 
-	return iter.Close()
+	destinationName := m.destinationName(c)
+
+	// Create the object of the document and fill in its properties with all the fields we were
+	// able to find, followed by the objects of child collections extracted from it.
+	for _, o := range getObjectsFromResult(id, result, c, destinationName) {
+		if err := m.naming.Apply(o); err != nil {
+			return err
+		}
+		publish(o)
+		logrus.WithFields(logrus.Fields{"ID": o.ID, "Collection": o.Collection, "Properties": o.Properties}).Debug("Published row")
+	}
+	return nil
+}
+
+// PublishDeletes publishes a tombstone for every document that was exported by the previous run
+// but is missing from the current one, and returns how many were found. It must only be called
+// after a scan completed successfully, otherwise documents we simply did not get to would be
+// reported as deleted.
+func (m *MongoDB) PublishDeletes(c *Collection, previous, current *CollectionState, publish func(o *objects.Object)) int {
+	deletedAt := time.Now().UTC()
+	count := 0
+	for destinationName, ids := range previous.Objects {
+		deleted := findDeletedIDs(ids, current.Objects[destinationName])
+		for _, id := range deleted {
+			publish(newTombstone(id, destinationName, deletedAt))
+		}
+		count += len(deleted)
+	}
+	logrus.WithFields(logrus.Fields{
+		"collection": c.CollectionName,
+		"deleted":    count,
+	}).Info("Deleted documents detected")
+
+	return count
+}
+
+// ResolveDestinationNames assigns the destination name of every collection of the description,
+// handling the collisions between them according to the naming policy.
+func (m *MongoDB) ResolveDestinationNames(d *Description) error {
+	collections := make(map[string]*Collection)
+	names := make(map[string]string)
+	for collection := range d.Iter() {
+		collection.destination = ""
+		collections[collection.CollectionName] = collection
+		names[collection.CollectionName] = m.destinationName(collection)
+	}
+
+	resolved, err := m.naming.Names(names)
+	if err != nil {
+		return fmt.Errorf("destination collections: %v", err)
+	}
+	for collectionName, destinationName := range resolved {
+		collections[collectionName].destination = destinationName
+		if err := m.resolvePropertyNames(collections[collectionName], destinationName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resolves the property names of a collection and of its child collections known from the schema,
+// so that they do not depend on the order in which properties show up in documents.
+func (m *MongoDB) resolvePropertyNames(c *Collection, destinationName string) error {
+	if err := m.naming.ResolvePropertyNames(destinationName, c.schemaPropertyNames()); err != nil {
+		return err
+	}
+	for _, child := range c.Children {
+		if err := m.resolvePropertyNames(&child.Collection, child.destinationName(destinationName)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The destination name (e.g. name of the collection in the warehouse) can be set by the user,
+// otherwise it is derived from the collection name in Mongo by the naming policy.
+func (m *MongoDB) destinationName(c *Collection) string {
+	if c.destination != "" {
+		return c.destination
+	}
+	if c.DestinationName != "" {
+		return m.naming.CollectionName(c.DestinationName)
+	}
+	return m.naming.DefaultCollectionName(m.DBName, c.CollectionName)
 }
 
 func (m *MongoDB) Close() {
+	if m.guard != nil {
+		m.guard.close()
+	}
 	if m.db != nil {
 		m.db.Session.Close()
 	}
@@ -146,6 +385,19 @@ func getIdFromResult(result map[string]interface{}) (string, error) {
 		id = _id
 	case bson.ObjectId:
 		id = _id.Hex()
+	case int, int64:
+		// Numeric ids are common in the output of aggregations grouping by a number.
+		id = fmt.Sprint(_id)
+	case float64:
+		id = strconv.FormatFloat(_id, 'f', -1, 64)
+	case map[string]interface{}, bson.M, []interface{}:
+		// Compound ids, e.g. of aggregations grouping by several fields, are serialized to JSON,
+		// whose keys are sorted, so that the same id always gives the same object.
+		b, err := json.Marshal(_id)
+		if err != nil {
+			return "", fmt.Errorf("'_id' value cannot be serialized: %v", err)
+		}
+		id = string(b)
 	default:
 		return "", errors.New(fmt.Sprintf("'_id' value is of unexpected type %T", result["_id"]))
 	}
@@ -154,36 +406,102 @@ func getIdFromResult(result map[string]interface{}) (string, error) {
 }
 
 func getPropertiesMapFromResult(result map[string]interface{}, c *Collection) map[string]interface{} {
+	var properties map[string]interface{}
+	if c.Mode == ModeExclude {
+		properties = getPropertiesMapExcludingFields(result, c)
+	} else {
+		properties = getPropertiesMapIncludingFields(result, c)
+	}
+
+	for _, field := range c.Computed {
+		setProperty(properties, field.destinationName(), field.evaluate(result), field)
+	}
+	return properties
+}
+
+func getPropertiesMapIncludingFields(result map[string]interface{}, c *Collection) map[string]interface{} {
 	properties := make(map[string]interface{})
 	for fieldName, field := range c.Fields {
-		value := getForNestedKey(result, fieldName)
+		if field == nil {
+			field = &Field{FieldName: fieldName}
+		}
 
-		// The field name (e.g. name of the field in the warehouse) can be set by the user,
-		// otherwise it just defaults to the field name in Mongo.
-		destinationName := fieldName
-		if field != nil && field.DestinationName != "" {
-			destinationName = field.DestinationName
-		}
-
-		// Set api does not allow array values and will throw 400 if you try sending an array
-		// as a property value. As a workaround we will serialize the array to JSON, which when used with
-		// redshift, can be fairly easily operated on using JSON operators.
-		// We also omit nil and undefined value because Set API will validate against them as well.
-		// Missing value will naturally show up in Redshift as NULL which fits our intention pretty well.
-		if _, ok := value.([]interface{}); ok {
-			arrayJSON, err := json.Marshal(value)
-			if err != nil {
-				logrus.Errorf("[Error] Unable to marshall value. Skipping `%v` err: %v", value, err)
-			} else {
-				properties[destinationName] = string(arrayJSON)
+		// Wildcard fields are expanded to the fields found in this document, fields that are also
+		// listed explicitly keep their own settings.
+		if isPattern(fieldName) {
+			for path, value := range expandPattern(result, fieldName) {
+				if _, ok := c.Fields[path]; !ok {
+					setProperty(properties, field.expandDestinationName(path), value, field)
+				}
 			}
-		} else if value != nil && value != bson.Undefined {
-			properties[destinationName] = value
+			continue
+		}
+
+		value := getForNestedKey(result, fieldName)
+		setProperty(properties, field.destinationName(), value, field)
+		if field.Reference != nil {
+			setReferenceProperties(properties, value, field)
 		}
 	}
 	return properties
 }
 
+// Flattens every field of the document into properties named after their path, except the fields
+// excluded by the collection, `_id` which is the id of the object already, and the arrays extracted
+// into child collections.
+func getPropertiesMapExcludingFields(result map[string]interface{}, c *Collection) map[string]interface{} {
+	excluded := append(c.GetFieldNames(), "_id")
+	for path := range c.Children {
+		excluded = append(excluded, path)
+	}
+
+	properties := make(map[string]interface{})
+	for path, value := range expandPattern(result, recursiveWildcard) {
+		if !isPathUnder(path, excluded) {
+			setProperty(properties, path, value, nil)
+		}
+	}
+	return properties
+}
+
+// Returns true if the path is one of the given paths or is nested under one of them.
+func isPathUnder(path string, paths []string) bool {
+	for _, p := range paths {
+		if path == p || strings.HasPrefix(path, p+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func setProperty(properties map[string]interface{}, destinationName string, value interface{}, field *Field) {
+	// Set api does not allow array values and will throw 400 if you try sending an array
+	// as a property value. As a workaround arrays are flattened according to the strategy of
+	// the field, by default serialized to JSON, which when used with redshift, can be fairly
+	// easily operated on using JSON operators.
+	if array, ok := value.([]interface{}); ok {
+		flattened, ok, err := flattenArray(array, field)
+		if err != nil {
+			logrus.Errorf("[Error] Unable to marshall value. Skipping field `%s` err: %v", destinationName, err)
+			return
+		}
+		value = nil
+		if ok {
+			value = flattened
+		}
+	}
+
+	// We also omit nil and undefined value because Set API will validate against them as well.
+	// Missing value will naturally show up in Redshift as NULL which fits our intention pretty well,
+	// unless the field has a default.
+	if value == bson.Undefined {
+		value = nil
+	}
+	if value, ok := field.convert(value); ok {
+		properties[destinationName] = value
+	}
+}
+
 // Searches for a value in the map if the key (which may refer to a nested field several levels deep).
 // If that value cannot be found, returns nil. For example, if the key "inner_dict.key_1" is passed in,
 // this method looks for a dict called inner_dict and then for a field keyed by "key_1" in that dict.
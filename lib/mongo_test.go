@@ -1,6 +1,7 @@
 package mongodb
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/deckarep/golang-set"
@@ -97,7 +98,10 @@ func (s *MongoTestSuite) TestGetDescription() {
 		t.Fatal(err)
 	}
 	for _, cName := range cNames {
-		cNamesSet.Add(cName)
+		// System collections are skipped by default.
+		if !strings.HasPrefix(cName, "system.") {
+			cNamesSet.Add(cName)
+		}
 	}
 
 	desc, err := app.GetDescription()
@@ -179,6 +183,30 @@ func (s *MongoTestSuite) TestGetIdFromResultObjectId() {
 	assert.Equal(s.T(), "57881f9ce8414cf291b44b4e", id)
 }
 
+func TestGetIdFromResultInt(t *testing.T) {
+	result := map[string]interface{}{
+		"_id": 42,
+	}
+
+	id, err := getIdFromResult(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "42", id)
+}
+
+func TestGetIdFromResultCompound(t *testing.T) {
+	id, err := getIdFromResult(map[string]interface{}{
+		"_id": bson.M{"user": bson.ObjectIdHex("57881f9ce8414cf291b44b4e"), "day": 12, "amount": 1.5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `{"amount":1.5,"day":12,"user":"57881f9ce8414cf291b44b4e"}`, id)
+}
+
 func (s *MongoTestSuite) TestGetIdFromResultNone() {
 	result := map[string]interface{}{}
 
@@ -186,6 +214,90 @@ func (s *MongoTestSuite) TestGetIdFromResultNone() {
 	assert.NotNil(s.T(), err)
 }
 
+func TestGetPropertiesMapExcludingFields(t *testing.T) {
+	result := map[string]interface{}{
+		"_id":      bson.ObjectIdHex("57881f9ce8414cf291b44b4e"),
+		"name":     "Apple",
+		"password": "hunter2",
+		"tags":     []interface{}{"fruit", "red"},
+		"translations": map[string]interface{}{
+			"spanish": "manzana",
+			"french":  "pomme",
+		},
+		"line_items": []interface{}{map[string]interface{}{"sku": "apple"}},
+	}
+	c := &Collection{
+		Mode: ModeExclude,
+		Fields: map[string]*Field{
+			"password":            nil,
+			"translations.french": nil,
+		},
+		Children: map[string]*Child{"line_items": {Path: "line_items"}},
+	}
+
+	assert.Equal(t, map[string]interface{}{
+		"name":                 "Apple",
+		"tags":                 `["fruit","red"]`,
+		"translations.spanish": "manzana",
+	}, getPropertiesMapFromResult(result, c))
+}
+
+func TestCollectionProjectionExcludeMode(t *testing.T) {
+	c := &Collection{
+		Mode: ModeExclude,
+		Fields: map[string]*Field{
+			"password":     nil,
+			"blob":         nil,
+			"blob.content": nil,
+		},
+	}
+
+	assert.Equal(t, map[string]interface{}{"password": 0, "blob": 0}, c.projection())
+}
+
+func TestParseSchemaInvalid(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		schema string
+	}{
+		{"unknown mode", `{"test": {"products": {"mode": "all", "fields": {}}}}`},
+		{"excluded _id", `{"test": {"products": {"mode": "exclude", "fields": {"_id": null}}}}`},
+		{"excluded wildcard", `{"test": {"products": {"mode": "exclude", "fields": {"translations.*": null}}}}`},
+		{"excluded transform", `{"test": {"products": {"mode": "exclude", "fields": {"email": {"transform": "sha256"}}}}}`},
+		{"unknown array strategy", `{"test": {"products": {"fields": {"tags": {"array": "explode"}, "name": {"array": "zip"}}}}}`},
+		{"wildcard in the middle", `{"test": {"products": {"fields": {"translations.*.name": null}}}}`},
+		{"exploded wildcard", `{"test": {"products": {"fields": {"tags.*": {"array": "explode"}}}}}`},
+		{"unknown transform", `{"test": {"users": {"fields": {"email": {"transform": "rot13"}}}}}`},
+		{"hmac without key", `{"test": {"users": {"fields": {"email": {"transform": "hmac"}}}}}`},
+		{"truncate without length", `{"test": {"users": {"fields": {"email": {"transform": "truncate"}}}}}`},
+		{"unknown type", `{"test": {"products": {"fields": {"cost": {"type": "decimal"}}}}}`},
+		{"default of another type", `{"test": {"products": {"fields": {"cost": {"type": "int", "default": "none"}}}}}`},
+		{"default without type", `{"test": {"products": {"fields": {"cost": {"default": 0}}}}}`},
+		{"unterminated expression", `{"test": {"users": {"computed": {"full_name": {"expression": "{{.first"}}}}}`},
+		{"unknown function", `{"test": {"users": {"computed": {"full_name": {"expression": "{{shout .first}}"}}}}}`},
+		{"computed without expression", `{"test": {"users": {"computed": {"full_name": null}}}}`},
+		{"pipeline without source", `{"test": {"v": {"pipeline": [{"$match": {}}], "fields": {"a": null}}}}`},
+		{"source without pipeline", `{"test": {"v": {"source": "orders", "fields": {"a": null}}}}`},
+		{"pipeline not a list", `{"test": {"v": {"source": "orders", "pipeline": {"$match": {}}}}}`},
+		{"stage of several operators", `{"test": {"v": {"source": "orders", "pipeline": [{"$match": {}, "$limit": 1}]}}}`},
+		{"child aggregation", `{"test": {"v": {"fields": {}, "children": {"items": {"source": "orders", "pipeline": [{"$limit": 1}]}}}}}`},
+		{"reference without collection", `{"test": {"c": {"fields": {"a": {"reference": {"fields": {"b": null}}}}}}}`},
+		{"wildcard reference", `{"test": {"c": {"fields": {"a.*": {"reference": {"collection": "d"}}}}}}`},
+		{"nested reference", `{"test": {"c": {"fields": {"a": {"reference": {"collection": "d", "fields": {"b": {"reference": {"collection": "e"}}}}}}}}}`},
+		{"invalid referenced field", `{"test": {"c": {"fields": {"a": {"reference": {"collection": "d", "fields": {"b": {"type": "date"}}}}}}}}`},
+		{"child reference", `{"test": {"c": {"fields": {}, "children": {"items": {"fields": {"a": {"reference": {"collection": "d"}}}}}}}}`},
+		{"negative batch size", `{"test": {"c": {"fields": {"a": null}, "cursor": {"batch_size": -1}}}}`},
+		{"prefetch above 1", `{"test": {"c": {"fields": {"a": null}, "cursor": {"prefetch": 2}}}}`},
+		{"negative max time", `{"test": {"c": {"fields": {"a": null}, "cursor": {"max_time_ms": -5}}}}`},
+		{"empty hint field", `{"test": {"c": {"fields": {"a": null}, "cursor": {"hint": ["-"]}}}}`},
+		{"unknown kind", `{"test": {"logs": {"kind": "clustered", "fields": {"msg": null}}}}`},
+		{"aggregation with a kind", `{"test": {"v": {"kind": "view", "source": "orders", "pipeline": [{"$limit": 1}], "fields": {"a": null}}}}`},
+	} {
+		_, err := NewDescriptionFromReader(strings.NewReader(c.schema))
+		assert.Error(t, err, c.name)
+	}
+}
+
 func connectToLocalMongo() (*mgo.Session, error) {
 	return mgo.DialWithInfo(&mgo.DialInfo{
 		Addrs:    []string{hostname + ":" + port},
@@ -0,0 +1,304 @@
+package mongodb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/segmentio/go-snakecase"
+	"github.com/segmentio/objects-go"
+)
+
+// Casing styles of destination names.
+const (
+	// CaseSnake splits words and joins them with underscores, e.g. `userId` becomes `user_id`.
+	CaseSnake = "snake"
+	// CaseLower lowercases names and replaces anything but letters and digits with underscores,
+	// e.g. `userId` becomes `userid`.
+	CaseLower = "lower"
+	// CaseNone leaves collection names as they are. Property names are always snake cased by the
+	// Objects API client, so this is the same as CaseSnake for them.
+	CaseNone = "none"
+)
+
+// Ways to handle several names that end up being the same destination name.
+const (
+	// CollisionsIgnore lets the last name win, in the alphabetical order of the source names.
+	CollisionsIgnore = "ignore"
+	// CollisionsSuffix appends `_2`, `_3`... to the names colliding with a previous one, in the
+	// alphabetical order of the source names.
+	CollisionsSuffix = "suffix"
+	// CollisionsError fails the scan.
+	CollisionsError = "error"
+)
+
+// Placeholders of NamingPolicy.Template.
+const (
+	DatabasePlaceholder   = "{db}"
+	CollectionPlaceholder = "{collection}"
+)
+
+// DefaultNamingTemplate names collections after their database and their name in Mongo.
+const DefaultNamingTemplate = DatabasePlaceholder + "_" + CollectionPlaceholder
+
+// NamingPolicy defines how destination names are derived. Template, Prefix, Suffix and Case apply
+// to the collections without an explicit destination name, which are used verbatim, and to all
+// property names. MaxLength and Collisions apply to the names of all collections and properties.
+// The destination name of a property is resolved once per collection, so that a field lands in the
+// same column in every object whatever the other fields of the object.
+type NamingPolicy struct {
+	Template   string
+	Prefix     string
+	Suffix     string
+	Case       string
+	MaxLength  int
+	Collisions string
+	// Redactor, if set, is told the names resolved for its sensitive properties, so that their
+	// values are redacted under those names too.
+	Redactor *Redactor
+
+	mu sync.Mutex
+	// Property names resolved so far, by destination collection.
+	properties map[string]*resolvedNames
+}
+
+// Destination names resolved so far, by source name, and the source names they were taken by.
+type resolvedNames struct {
+	names map[string]string
+	taken map[string]string
+}
+
+func newResolvedNames() *resolvedNames {
+	return &resolvedNames{names: make(map[string]string), taken: make(map[string]string)}
+}
+
+func NewNamingPolicy() *NamingPolicy {
+	return &NamingPolicy{
+		Template:   DefaultNamingTemplate,
+		Case:       CaseSnake,
+		Collisions: CollisionsIgnore,
+	}
+}
+
+func (p *NamingPolicy) Validate() error {
+	if !strings.Contains(p.Template, CollectionPlaceholder) {
+		return fmt.Errorf("naming template %q must contain %s", p.Template, CollectionPlaceholder)
+	}
+	switch p.Case {
+	case CaseSnake, CaseLower, CaseNone:
+	default:
+		return fmt.Errorf("unknown naming case %q, expected %q, %q or %q", p.Case, CaseSnake, CaseLower, CaseNone)
+	}
+	switch p.Collisions {
+	case CollisionsIgnore, CollisionsSuffix, CollisionsError:
+	default:
+		return fmt.Errorf("unknown naming collisions %q, expected %q, %q or %q", p.Collisions, CollisionsIgnore, CollisionsSuffix, CollisionsError)
+	}
+	if p.MaxLength < 0 {
+		return fmt.Errorf("naming max length must not be negative")
+	}
+	return nil
+}
+
+// DefaultCollectionName returns the destination of a collection without an explicit one.
+func (p *NamingPolicy) DefaultCollectionName(dbName, collectionName string) string {
+	name := strings.NewReplacer(DatabasePlaceholder, dbName, CollectionPlaceholder, collectionName).Replace(p.Template)
+	return p.truncate(p.applyCase(p.Prefix+name+p.Suffix, p.Case))
+}
+
+// CollectionName applies the maximum length of the policy to an explicit collection name.
+func (p *NamingPolicy) CollectionName(name string) string {
+	return p.truncate(name)
+}
+
+// PropertyName applies the casing and the maximum length of the policy to a property name.
+func (p *NamingPolicy) PropertyName(name string) string {
+	style := p.Case
+	if style == CaseNone {
+		style = CaseSnake
+	}
+	return p.truncate(p.applyCase(name, style))
+}
+
+// Names resolves the destination names of a set of source names, handling collisions between them.
+// Returns a map from source name to destination name.
+func (p *NamingPolicy) Names(names map[string]string) (map[string]string, error) {
+	resolved := newResolvedNames()
+	for _, source := range sortedKeys(names) {
+		if _, err := p.resolve(resolved, source, names[source]); err != nil {
+			return nil, err
+		}
+	}
+	return resolved.names, nil
+}
+
+// Returns the destination name of a source name, unless it was resolved already, handling its
+// collisions with the names resolved before.
+func (p *NamingPolicy) resolve(resolved *resolvedNames, source, name string) (string, error) {
+	if name, ok := resolved.names[source]; ok {
+		return name, nil
+	}
+	if other, ok := resolved.taken[name]; ok {
+		switch p.Collisions {
+		case CollisionsError:
+			return "", fmt.Errorf("%q and %q are both named %q", other, source, name)
+		case CollisionsSuffix:
+			name = p.nextFreeName(name, resolved.taken)
+		}
+	}
+	resolved.taken[name] = source
+	resolved.names[source] = name
+	if p.Redactor != nil && p.Redactor.sensitive(source) {
+		p.Redactor.AddFields(name)
+	}
+	return name, nil
+}
+
+// ResolvePropertyNames resolves the destination names of the properties of a collection known
+// beforehand, e.g. from the schema, in alphabetical order. Properties found later in the objects
+// of the collection are resolved when first seen, after these.
+func (p *NamingPolicy) ResolvePropertyNames(collection string, sources []string) error {
+	resolved := newResolvedNames()
+	sorted := append([]string(nil), sources...)
+	sort.Strings(sorted)
+	for _, source := range sorted {
+		if _, err := p.resolve(resolved, source, p.PropertyName(source)); err != nil {
+			return fmt.Errorf("properties of %q: %v", collection, err)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.properties == nil {
+		p.properties = make(map[string]*resolvedNames)
+	}
+	p.properties[p.CollectionName(collection)] = resolved
+	return nil
+}
+
+// Apply renames the collection and the properties of an object according to the policy. Nested
+// properties are flattened the way the Objects API client would, so that the policy applies to
+// their final names too.
+func (p *NamingPolicy) Apply(o *objects.Object) error {
+	o.Collection = p.CollectionName(o.Collection)
+
+	flat := make(map[string]interface{}, len(o.Properties))
+	flattenProperties(flat, o.Properties, "")
+	sources := make([]string, 0, len(flat))
+	for source := range flat {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.properties == nil {
+		p.properties = make(map[string]*resolvedNames)
+	}
+	resolved, ok := p.properties[o.Collection]
+	if !ok {
+		resolved = newResolvedNames()
+		p.properties[o.Collection] = resolved
+	}
+
+	properties := make(map[string]interface{}, len(flat))
+	for _, source := range sources {
+		name, err := p.resolve(resolved, source, p.PropertyName(source))
+		if err != nil {
+			return fmt.Errorf("object %q of %q: %v", o.ID, o.Collection, err)
+		}
+		properties[name] = flat[source]
+	}
+	o.Properties = properties
+	return nil
+}
+
+// Returns the names of the properties of the collection known from its schema, i.e. those of its
+// fields and computed fields. Properties of fields matched by wildcards or exported in exclude mode
+// are only known from the documents.
+func (c *Collection) schemaPropertyNames() []string {
+	var names []string
+	if c.Mode != ModeExclude {
+		for fieldName, field := range c.Fields {
+			if field == nil {
+				field = &Field{FieldName: fieldName}
+			}
+			if !isPattern(fieldName) {
+				names = append(names, field.destinationName())
+			}
+		}
+	}
+	for name := range c.Computed {
+		names = append(names, name)
+	}
+	return names
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func flattenProperties(flat map[string]interface{}, properties map[string]interface{}, prefix string) {
+	for key, value := range properties {
+		if sub, ok := value.(map[string]interface{}); ok {
+			flattenProperties(flat, sub, prefix+key+"_")
+			continue
+		}
+		flat[prefix+key] = value
+	}
+}
+
+func (p *NamingPolicy) applyCase(name string, style string) string {
+	switch style {
+	case CaseSnake:
+		return snakecase.Snakecase(name)
+	case CaseLower:
+		return strings.Trim(strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+				return r
+			case r >= 'A' && r <= 'Z':
+				return r - 'A' + 'a'
+			}
+			return '_'
+		}, name), "_")
+	}
+	return name
+}
+
+// Truncates a name to the maximum length of the policy, in characters.
+func (p *NamingPolicy) truncate(name string) string {
+	return truncateRunes(name, p.MaxLength)
+}
+
+func truncateRunes(s string, n int) string {
+	if n <= 0 || utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+func (p *NamingPolicy) nextFreeName(name string, taken map[string]string) string {
+	for i := 2; ; i++ {
+		suffix := fmt.Sprintf("_%d", i)
+		base := name
+		if p.MaxLength > 0 && utf8.RuneCountInString(base)+len(suffix) > p.MaxLength {
+			cut := p.MaxLength - len(suffix)
+			if cut <= 0 {
+				base = ""
+			} else {
+				base = truncateRunes(base, cut)
+			}
+		}
+		if _, ok := taken[base+suffix]; !ok {
+			return base + suffix
+		}
+	}
+}
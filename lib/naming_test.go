@@ -0,0 +1,115 @@
+package mongodb
+
+import (
+	"testing"
+
+	"github.com/segmentio/objects-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamingPolicyCollectionNames(t *testing.T) {
+	p := NewNamingPolicy()
+	assert.Equal(t, "test_product_items", p.DefaultCollectionName("test", "productItems"))
+	assert.Equal(t, "MyProducts", p.CollectionName("MyProducts"), "explicit names are used verbatim")
+
+	p.Template = "mongo_{collection}"
+	p.Prefix = "raw_"
+	p.Case = CaseLower
+	p.MaxLength = 16
+	assert.Equal(t, "raw_mongo_produc", p.DefaultCollectionName("test", "productItems"))
+
+	p.Case = CaseNone
+	p.MaxLength = 0
+	assert.Equal(t, "raw_mongo_productItems", p.DefaultCollectionName("test", "productItems"))
+}
+
+func TestNamingPolicyCollisions(t *testing.T) {
+	names := map[string]string{"userId": "user_id", "user_id": "user_id", "name": "name"}
+
+	p := NewNamingPolicy()
+	p.Collisions = CollisionsSuffix
+	resolved, err := p.Names(names)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"userId": "user_id", "user_id": "user_id_2", "name": "name"}, resolved)
+
+	p.Collisions = CollisionsError
+	_, err = p.Names(names)
+	assert.Error(t, err)
+
+	p.Collisions = CollisionsIgnore
+	resolved, err = p.Names(names)
+	assert.NoError(t, err)
+	assert.Equal(t, names, resolved)
+}
+
+func TestNamingPolicyApply(t *testing.T) {
+	p := NewNamingPolicy()
+	p.MaxLength = 12
+	p.Collisions = CollisionsSuffix
+	o := &objects.Object{
+		ID:         "abc123",
+		Collection: "test_products_with_a_long_name",
+		Properties: map[string]interface{}{
+			"translations.spanish": "manzana",
+			"translations": map[string]interface{}{
+				"french": "pomme",
+			},
+			"costInDollars": 1.27,
+		},
+	}
+
+	assert.NoError(t, p.Apply(o))
+	assert.Equal(t, "test_product", o.Collection)
+	assert.Equal(t, map[string]interface{}{
+		"translations": "manzana",
+		"translatio_2": "pomme",
+		"cost_in_doll": 1.27,
+	}, o.Properties)
+}
+
+func TestNamingPolicyApplyStableCollisions(t *testing.T) {
+	p := NewNamingPolicy()
+	p.Collisions = CollisionsSuffix
+	assert.NoError(t, p.ResolvePropertyNames("test_users", []string{"userId", "user_id"}))
+
+	// Each object only has one of the colliding fields, which keeps its column anyway.
+	o := &objects.Object{ID: "1", Collection: "test_users", Properties: map[string]interface{}{"user_id": 1}}
+	assert.NoError(t, p.Apply(o))
+	assert.Equal(t, map[string]interface{}{"user_id_2": 1}, o.Properties)
+
+	o = &objects.Object{ID: "2", Collection: "test_users", Properties: map[string]interface{}{"userId": 2}}
+	assert.NoError(t, p.Apply(o))
+	assert.Equal(t, map[string]interface{}{"user_id": 2}, o.Properties)
+
+	// Properties unknown beforehand are resolved when first seen.
+	o = &objects.Object{ID: "3", Collection: "test_users", Properties: map[string]interface{}{"USER_ID": 3}}
+	assert.NoError(t, p.Apply(o))
+	assert.Equal(t, map[string]interface{}{"user_id_3": 3}, o.Properties)
+	o = &objects.Object{ID: "4", Collection: "test_users", Properties: map[string]interface{}{"USER_ID": 4, "userId": 4}}
+	assert.NoError(t, p.Apply(o))
+	assert.Equal(t, map[string]interface{}{"user_id": 4, "user_id_3": 4}, o.Properties)
+}
+
+func TestNamingPolicyTruncateRunes(t *testing.T) {
+	p := NewNamingPolicy()
+	p.Case = CaseNone
+	p.MaxLength = 4
+	p.Collisions = CollisionsSuffix
+	assert.Equal(t, "çaée", p.CollectionName("çaéeü"))
+
+	resolved, err := p.Names(map[string]string{"a": "éééé", "b": "éééé"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "éééé", "b": "éé_2"}, resolved)
+}
+
+func TestNamingPolicyValidate(t *testing.T) {
+	assert.NoError(t, NewNamingPolicy().Validate())
+	for _, p := range []*NamingPolicy{
+		{Template: "{db}", Case: CaseSnake, Collisions: CollisionsIgnore},
+		{Template: DefaultNamingTemplate, Case: "camel", Collisions: CollisionsIgnore},
+		{Template: DefaultNamingTemplate, Case: CaseSnake, Collisions: "merge"},
+		{Template: DefaultNamingTemplate, Case: CaseSnake, Collisions: CollisionsIgnore, MaxLength: -1},
+	} {
+		assert.Error(t, p.Validate())
+	}
+}
@@ -0,0 +1,291 @@
+package mongodb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Options that only make sense on the command line.
+var commandLineOnly = map[string]bool{
+	"config":  true,
+	"help":    true,
+	"version": true,
+}
+
+// Options read from a file instead, by the name of the option they replace.
+var secretFiles = map[string]string{
+	"password-file":  "password",
+	"write-key-file": "write-key",
+}
+
+// Options of the Segment side, read from `SEGMENT_*` environment variables rather than
+// `MONGODB_*` ones.
+var segmentOptions = map[string]bool{
+	"write-key":                  true,
+	"write-key-file":             true,
+	"endpoint":                   true,
+	"max-batch-count":            true,
+	"max-batch-bytes":            true,
+	"max-batch-interval":         true,
+	"http-timeout":               true,
+	"parallel-requests":          true,
+	"delivery-retry-max-elapsed": true,
+}
+
+// ResolveOptions completes the arguments parsed by docopt with the options of the environment and
+// of the configuration file. By order of precedence, options are taken from the command line, then
+// environment variables, then the configuration file, then the defaults of the usage.
+func ResolveOptions(args map[string]interface{}, argv []string, environ []string) error {
+	given := FlagsGiven(argv, args)
+
+	cli := make(map[string]interface{})
+	for name := range given {
+		if value, ok := args["--"+name]; ok && value != nil {
+			cli[name] = value
+		}
+	}
+	if err := readSecretFiles(cli); err != nil {
+		return err
+	}
+	for name, value := range cli {
+		args["--"+name] = value
+		given[name] = true
+	}
+
+	env, err := EnvOptions(args, environ)
+	if err != nil {
+		return err
+	}
+	if err := readSecretFiles(env); err != nil {
+		return err
+	}
+	// The configuration file itself may come from the environment, but not from the file.
+	if path, ok := env["config"]; ok {
+		delete(env, "config")
+		if !given["config"] {
+			args["--config"] = path
+		}
+	}
+	if err := MergeOptions(args, env, given); err != nil {
+		return err
+	}
+	for name := range env {
+		given[name] = true
+	}
+
+	path, _ := args["--config"].(string)
+	if path == "" {
+		return nil
+	}
+	file, err := LoadOptionsFile(path)
+	if err != nil {
+		return err
+	}
+	if err := readSecretFiles(file); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if err := MergeOptions(args, file, given); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// EnvVar returns the environment variable of an option, e.g. MONGODB_PASSWORD or SEGMENT_WRITE_KEY.
+func EnvVar(name string) string {
+	prefix := "MONGODB_"
+	if segmentOptions[name] {
+		prefix = "SEGMENT_"
+	}
+	return prefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// EnvOptions returns the options of the arguments parsed by docopt that are set in the
+// environment. Empty variables are ignored.
+func EnvOptions(args map[string]interface{}, environ []string) (map[string]interface{}, error) {
+	vars := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		if equal := strings.Index(kv, "="); equal > 0 {
+			vars[kv[:equal]] = kv[equal+1:]
+		}
+	}
+
+	options := make(map[string]interface{})
+	for flag, current := range args {
+		name := strings.TrimPrefix(flag, "--")
+		if name == flag || (commandLineOnly[name] && name != "config") {
+			continue
+		}
+		value := vars[EnvVar(name)]
+		if value == "" {
+			continue
+		}
+		if _, isFlag := current.(bool); !isFlag {
+			options[name] = value
+			continue
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be true or false", EnvVar(name))
+		}
+		options[name] = b
+	}
+	return options, nil
+}
+
+// Replaces the secret files of options with their content. Trailing new lines are dropped, as most
+// editors add one.
+func readSecretFiles(options map[string]interface{}) error {
+	for fileOption, option := range secretFiles {
+		value, ok := options[fileOption]
+		if !ok {
+			continue
+		}
+		if _, ok := options[option]; ok {
+			return fmt.Errorf("options %q and %q are exclusive", option, fileOption)
+		}
+		path, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("option %q must be a path", fileOption)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("option %q: %v", fileOption, err)
+		}
+		options[option] = strings.TrimRight(string(b), "\r\n")
+	}
+	return nil
+}
+
+// LoadOptionsFile reads the options of a JSON configuration file, by flag name without the leading
+// dashes. The file holds a flat object of options to values. Values are strings, numbers or
+// booleans, lists are joined with commas.
+func LoadOptionsFile(path string) (map[string]interface{}, error) {
+	if ext := strings.ToLower(filepath.Ext(path)); ext != ".json" {
+		return nil, fmt.Errorf("%s: unsupported configuration format %q, only .json files are supported", path, ext)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	options, err := parseJSONOptions(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return options, nil
+}
+
+func parseJSONOptions(b []byte) (map[string]interface{}, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+
+	options := make(map[string]interface{}, len(raw))
+	for key, value := range raw {
+		v, err := jsonOptionValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("option %q: %v", key, err)
+		}
+		options[key] = v
+	}
+	return options, nil
+}
+
+func jsonOptionValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case bool, string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := jsonOptionValue(item)
+			if err != nil {
+				return nil, err
+			}
+			if items[i], _ = s.(string); items[i] == "" {
+				return nil, fmt.Errorf("lists must hold strings or numbers")
+			}
+		}
+		return strings.Join(items, ","), nil
+	}
+	return nil, fmt.Errorf("unsupported value %v", value)
+}
+
+// FlagsGiven returns the names of the flags given on the command line, without the leading dashes.
+// Like docopt, flags may be abbreviated to a prefix of a single option of the arguments it parsed,
+// e.g. `--pass` for `--password`.
+func FlagsGiven(argv []string, args map[string]interface{}) map[string]bool {
+	given := make(map[string]bool)
+	for _, arg := range argv {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "--") {
+			continue
+		}
+		name := strings.TrimPrefix(arg, "--")
+		if equal := strings.Index(name, "="); equal >= 0 {
+			name = name[:equal]
+		}
+		given[expandFlag(name, args)] = true
+	}
+	return given
+}
+
+// Returns the name of the option a flag abbreviates, or the flag itself if it is an option or
+// abbreviates none or several of them.
+func expandFlag(name string, args map[string]interface{}) string {
+	if _, ok := args["--"+name]; ok {
+		return name
+	}
+	expanded := ""
+	for flag := range args {
+		if !strings.HasPrefix(flag, "--"+name) {
+			continue
+		}
+		if expanded != "" {
+			return name
+		}
+		expanded = strings.TrimPrefix(flag, "--")
+	}
+	if expanded == "" {
+		return name
+	}
+	return expanded
+}
+
+// MergeOptions sets options in the arguments parsed by docopt, unless their flag was given on the
+// command line. Flags take booleans, other options strings.
+func MergeOptions(args map[string]interface{}, options map[string]interface{}, given map[string]bool) error {
+	for name, value := range options {
+		flag := "--" + name
+		current, ok := args[flag]
+		if !ok || commandLineOnly[name] {
+			return fmt.Errorf("unknown option %q", name)
+		}
+		if given[name] {
+			continue
+		}
+
+		if _, isFlag := current.(bool); isFlag {
+			b, ok := value.(bool)
+			if !ok {
+				return fmt.Errorf("option %q must be true or false", name)
+			}
+			args[flag] = b
+			continue
+		}
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("option %q must be a string, not %v", name, value)
+		}
+		args[flag] = s
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package mongodb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadOptionsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongodb-options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	expected := map[string]interface{}{
+		"hostname":       "mongo-1",
+		"port":           "27017",
+		"password":       "s3cr#t",
+		"secondary":      true,
+		"sort":           "created_at,-_id",
+		"naming-case":    "lower",
+		"max-lag":        "30s",
+		"detect-deletes": false,
+	}
+	path := filepath.Join(dir, "config.json")
+	content := `{
+		"hostname": "mongo-1", "port": 27017, "password": "s3cr#t", "secondary": true,
+		"sort": ["created_at", "-_id"], "naming-case": "lower", "max-lag": "30s", "detect-deletes": false
+	}`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options, err := LoadOptionsFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, options)
+
+	for name, content := range map[string]string{
+		"config.ini":        "hostname=mongo-1",
+		"config.yaml":       "hostname: mongo-1\n",
+		"config.toml":       "hostname = \"mongo-1\"\n",
+		"object.json":       `{"cursor": {"batch_size": 10}}`,
+		"list.json":         `{"sort": [true]}`,
+		"unterminated.json": `{"sort": ["created_at"`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadOptionsFile(path)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestMergeOptions(t *testing.T) {
+	args := map[string]interface{}{
+		"--hostname":    nil,
+		"--port":        nil,
+		"--concurrency": "1",
+		"--secondary":   false,
+		"--config":      "config.json",
+	}
+	err := MergeOptions(args, map[string]interface{}{
+		"hostname":    "mongo-1",
+		"port":        "27017",
+		"concurrency": "4",
+		"secondary":   true,
+	}, FlagsGiven([]string{"--config=config.json", "--port=27018", "--concurrency", "2"}, args))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"--hostname":    "mongo-1",
+		"--port":        nil,
+		"--concurrency": "1",
+		"--secondary":   true,
+		"--config":      "config.json",
+	}, args)
+
+	for _, options := range []map[string]interface{}{
+		{"hostnme": "mongo-1"},
+		{"config": "other.json"},
+		{"secondary": "yes"},
+		{"hostname": true},
+	} {
+		assert.Error(t, MergeOptions(args, options, nil), fmt.Sprintf("%v", options))
+	}
+}
+
+func TestFlagsGivenAbbreviated(t *testing.T) {
+	args := map[string]interface{}{
+		"--password":      nil,
+		"--password-file": nil,
+		"--database":      nil,
+		"--debug":         false,
+		"--port":          nil,
+	}
+	assert.Equal(t, map[string]bool{
+		"password": true,
+		"database": true,
+		"port":     true,
+		"debug":    true,
+		"pa":       true,
+	}, FlagsGiven([]string{"--password=x", "--data=shop", "--po", "27017", "--de", "--pa"}, args), "ambiguous prefixes are kept")
+	assert.Equal(t, map[string]bool{"password-file": true}, FlagsGiven([]string{"--password-f=secret"}, args))
+}
+
+func TestValidateConfig(t *testing.T) {
+	_, err := govalidator.ValidateStruct(&Config{Hostname: "mongo-1", Port: "27017", Database: "shop"})
+	assert.NoError(t, err)
+
+	_, err = govalidator.ValidateStruct(&Config{Port: "70000"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "hostname is required")
+		assert.Contains(t, err.Error(), "port must be a number between 1 and 65535")
+		assert.Contains(t, err.Error(), "database is required")
+	}
+}
+
+func TestEnvVar(t *testing.T) {
+	assert.Equal(t, "MONGODB_PASSWORD", EnvVar("password"))
+	assert.Equal(t, "MONGODB_BATCH_SIZE", EnvVar("batch-size"))
+	assert.Equal(t, "SEGMENT_WRITE_KEY", EnvVar("write-key"))
+	assert.Equal(t, "SEGMENT_WRITE_KEY_FILE", EnvVar("write-key-file"))
+}
+
+func TestResolveOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongodb-options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "config.json")
+	secret := filepath.Join(dir, "password")
+	writeKey := filepath.Join(dir, "write-key")
+	for path, content := range map[string]string{
+		config:   `{"hostname": "mongo-1", "port": 27017, "username": "file", "password": "file", "secondary": true}`,
+		secret:   "s3cret\n",
+		writeKey: "ab-200-1alx91kx",
+	} {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	args := func() map[string]interface{} {
+		return map[string]interface{}{
+			"--config":         nil,
+			"--hostname":       nil,
+			"--port":           nil,
+			"--username":       nil,
+			"--password":       nil,
+			"--password-file":  nil,
+			"--write-key":      nil,
+			"--write-key-file": nil,
+			"--secondary":      false,
+			"--help":           false,
+		}
+	}
+
+	// The command line wins over the environment, which wins over the file.
+	a := args()
+	a["--port"] = "27018"
+	a["--password-file"] = secret
+	err = ResolveOptions(a, []string{"--port=27018", "--password-file", secret}, []string{
+		"MONGODB_CONFIG=" + config,
+		"MONGODB_USERNAME=env",
+		"MONGODB_PASSWORD=env",
+		"MONGODB_HOSTNAME=",
+		"SEGMENT_WRITE_KEY_FILE=" + writeKey,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "mongo-1", a["--hostname"])
+	assert.Equal(t, "27018", a["--port"])
+	assert.Equal(t, "env", a["--username"])
+	assert.Equal(t, "s3cret", a["--password"])
+	assert.Equal(t, "ab-200-1alx91kx", a["--write-key"])
+	assert.Equal(t, true, a["--secondary"])
+
+	// A secret and its file are exclusive at the same level only.
+	a = args()
+	a["--password"] = "flag"
+	a["--password-file"] = secret
+	assert.Error(t, ResolveOptions(a, []string{"--password=flag", "--password-file=" + secret}, nil))
+	assert.Error(t, ResolveOptions(args(), nil, []string{"MONGODB_PASSWORD=env", "MONGODB_PASSWORD_FILE=" + secret}))
+
+	assert.Error(t, ResolveOptions(args(), nil, []string{"MONGODB_SECONDARY=maybe"}))
+	assert.Error(t, ResolveOptions(args(), nil, []string{"MONGODB_PASSWORD_FILE=" + filepath.Join(dir, "missing")}))
+}
@@ -0,0 +1,95 @@
+package mongodb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Parses an aggregation pipeline from JSON. Stages are decoded to ordered documents since the order
+// of keys matters for some of them, e.g. the keys of a `$sort`.
+func parsePipeline(raw json.RawMessage) ([]bson.D, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+
+	value, err := decodeOrdered(dec)
+	if err != nil {
+		return nil, err
+	}
+
+	stages, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("pipeline must be an array of stages")
+	}
+
+	pipeline := make([]bson.D, 0, len(stages))
+	for i, stage := range stages {
+		doc, ok := stage.(bson.D)
+		if !ok || len(doc) != 1 {
+			return nil, fmt.Errorf("stage %d of pipeline must be a document with a single operator", i)
+		}
+		pipeline = append(pipeline, doc)
+	}
+	return pipeline, nil
+}
+
+// Decodes the next JSON value, objects as bson.D and numbers as int64 or float64.
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := token.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			doc := bson.D{}
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := decodeOrdered(dec)
+				if err != nil {
+					return nil, err
+				}
+				doc = append(doc, bson.DocElem{Name: key.(string), Value: value})
+			}
+			_, err := dec.Token()
+			return doc, err
+		case '[':
+			array := []interface{}{}
+			for dec.More() {
+				value, err := decodeOrdered(dec)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, value)
+			}
+			_, err := dec.Token()
+			return array, err
+		}
+		return nil, io.ErrUnexpectedEOF
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i, nil
+		}
+		return t.Float64()
+	default:
+		return t, nil
+	}
+}
+
+// Returns the pipeline of a virtual collection, followed by a `$project` stage limiting its output
+// to the fields needed if they are known.
+func (c *Collection) aggregation(fieldsToInclude map[string]interface{}) []bson.D {
+	pipeline := append([]bson.D{}, c.pipeline...)
+	if len(fieldsToInclude) > 0 {
+		pipeline = append(pipeline, bson.D{{Name: "$project", Value: fieldsToInclude}})
+	}
+	return pipeline
+}
@@ -0,0 +1,39 @@
+package mongodb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const pipelineSchema = `{"test": {"orders_by_user": {
+	"source": "orders",
+	"pipeline": [
+		{"$match": {"status": "paid"}},
+		{"$group": {"_id": "$user_id", "total": {"$sum": "$total"}, "count": {"$sum": 1}}},
+		{"$sort": {"total": -1, "_id": 1}}
+	],
+	"fields": {"total": null, "count": {"type": "int"}}
+}}}`
+
+func TestParseSchemaPipeline(t *testing.T) {
+	desc, err := NewDescriptionFromReader(strings.NewReader(pipelineSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := desc.schemas["test"]["orders_by_user"]
+
+	assert.True(t, c.IsVirtual())
+	assert.Equal(t, []bson.D{
+		{{Name: "$match", Value: bson.D{{Name: "status", Value: "paid"}}}},
+		{{Name: "$group", Value: bson.D{
+			{Name: "_id", Value: "$user_id"},
+			{Name: "total", Value: bson.D{{Name: "$sum", Value: "$total"}}},
+			{Name: "count", Value: bson.D{{Name: "$sum", Value: int64(1)}}},
+		}}},
+		{{Name: "$sort", Value: bson.D{{Name: "total", Value: int64(-1)}, {Name: "_id", Value: int64(1)}}}},
+		{{Name: "$project", Value: map[string]interface{}{"total": 1, "count": 1}}},
+	}, c.aggregation(c.projection()))
+}
@@ -0,0 +1,195 @@
+package mongodb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// How often the load of the server is checked in adaptive mode.
+const adaptiveInterval = 10 * time.Second
+
+// Lowest fraction of the configured rates adaptive mode slows down to.
+const minRateFactor = 1.0 / 64
+
+// RateLimit caps how fast documents are read, across all the collections scanned in parallel.
+type RateLimit struct {
+	// DocsPerSecond is the maximum number of documents read per second, 0 for no limit.
+	DocsPerSecond float64
+	// BytesPerSecond is the maximum number of BSON bytes read per second, 0 for no limit.
+	BytesPerSecond float64
+	// Adaptive halves the rates while the server is under load, then restores them gradually.
+	Adaptive bool
+	// MaxQueue is the number of operations queued on the server above which it is under load.
+	MaxQueue int
+	// MaxLag is the replication lag of the secondaries above which the server is under load.
+	MaxLag time.Duration
+}
+
+func (r *RateLimit) Validate() error {
+	if r == nil {
+		return nil
+	}
+	if r.DocsPerSecond < 0 || r.BytesPerSecond < 0 {
+		return fmt.Errorf("read rates must not be negative")
+	}
+	if r.Adaptive {
+		if r.DocsPerSecond == 0 && r.BytesPerSecond == 0 {
+			return fmt.Errorf("adaptive rate limiting requires a documents or bytes per second rate")
+		}
+		if r.MaxQueue <= 0 && r.MaxLag <= 0 {
+			return fmt.Errorf("adaptive rate limiting requires a maximum queue length or replication lag")
+		}
+	}
+	return nil
+}
+
+// Token bucket allowing bursts of a second worth of tokens.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Takes n tokens refilled at the given rate, returns how long to wait for the balance to be
+// positive again.
+func (b *bucket) take(n, rate float64, now time.Time) time.Duration {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+	} else {
+		b.tokens = rate
+	}
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// Limits the rate documents are read at. A nil limiter does not limit anything.
+type rateLimiter struct {
+	limit *RateLimit
+
+	mu     sync.Mutex
+	docs   bucket
+	bytes  bucket
+	factor float64
+}
+
+func newRateLimiter(limit *RateLimit) *rateLimiter {
+	if limit == nil || (limit.DocsPerSecond == 0 && limit.BytesPerSecond == 0) {
+		return nil
+	}
+	return &rateLimiter{limit: limit, factor: 1}
+}
+
+// Accounts for a document of the given size, waiting as long as needed to stay under the rates.
+func (l *rateLimiter) wait(size int) {
+	if l == nil {
+		return
+	}
+	time.Sleep(l.reserve(size, time.Now()))
+}
+
+func (l *rateLimiter) reserve(size int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var delay time.Duration
+	if l.limit.DocsPerSecond > 0 {
+		delay = l.docs.take(1, l.limit.DocsPerSecond*l.factor, now)
+	}
+	if l.limit.BytesPerSecond > 0 {
+		if d := l.bytes.take(float64(size), l.limit.BytesPerSecond*l.factor, now); d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// Slows down while the server is under load and speeds up again once it is not. Returns the new
+// factor applied to the rates.
+func (l *rateLimiter) adapt(loaded bool) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if loaded {
+		l.factor /= 2
+		if l.factor < minRateFactor {
+			l.factor = minRateFactor
+		}
+	} else {
+		l.factor *= 2
+		if l.factor > 1 {
+			l.factor = 1
+		}
+	}
+	return l.factor
+}
+
+// Load of the server, as far as adaptive rate limiting is concerned.
+type serverLoad struct {
+	queue int
+	lag   time.Duration
+}
+
+func (l *rateLimiter) loaded(load serverLoad) bool {
+	return (l.limit.MaxQueue > 0 && load.queue > l.limit.MaxQueue) ||
+		(l.limit.MaxLag > 0 && load.lag > l.limit.MaxLag)
+}
+
+// Checks the load of the server periodically and adapts the rates until stop is closed.
+func (m *MongoDB) adaptRate(l *rateLimiter, stop <-chan struct{}) {
+	ticker := time.NewTicker(adaptiveInterval)
+	defer ticker.Stop()
+
+	factor := 1.0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		load, err := m.serverLoad()
+		if err != nil {
+			logrus.WithError(err).Warn("Unable to check the load of the server")
+			continue
+		}
+		if next := l.adapt(l.loaded(load)); next != factor {
+			factor = next
+			logrus.WithFields(logrus.Fields{
+				"queue":  load.queue,
+				"lag":    load.lag,
+				"factor": factor,
+			}).Info("Read rate adapted to the load of the server")
+		}
+	}
+}
+
+// Returns the number of operations queued on the server and the replication lag of its slowest
+// secondary, or 0 if it is not part of a replica set.
+func (m *MongoDB) serverLoad() (serverLoad, error) {
+	var status struct {
+		GlobalLock struct {
+			CurrentQueue struct {
+				Total int `bson:"total"`
+			} `bson:"currentQueue"`
+		} `bson:"globalLock"`
+	}
+	if err := m.db.Session.Run(bson.D{{Name: "serverStatus", Value: 1}}, &status); err != nil {
+		return serverLoad{}, err
+	}
+
+	load := serverLoad{queue: status.GlobalLock.CurrentQueue.Total}
+	if members, err := m.replicaSetMembers(); err == nil {
+		load.lag = maxLag(members)
+	}
+	return load, nil
+}
@@ -0,0 +1,81 @@
+package mongodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterDocs(t *testing.T) {
+	l := newRateLimiter(&RateLimit{DocsPerSecond: 10})
+	now := time.Unix(0, 0)
+
+	// A second worth of documents goes through right away, the next ones are spaced out.
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, time.Duration(0), l.reserve(100, now))
+	}
+	assert.Equal(t, 100*time.Millisecond, l.reserve(100, now))
+	assert.Equal(t, 200*time.Millisecond, l.reserve(100, now))
+	assert.Equal(t, 100*time.Millisecond, l.reserve(100, now.Add(200*time.Millisecond)))
+}
+
+func TestRateLimiterBytes(t *testing.T) {
+	l := newRateLimiter(&RateLimit{DocsPerSecond: 1000, BytesPerSecond: 1000})
+	now := time.Unix(0, 0)
+
+	assert.Equal(t, time.Duration(0), l.reserve(1000, now))
+	assert.Equal(t, 500*time.Millisecond, l.reserve(500, now))
+}
+
+func TestRateLimiterAdaptive(t *testing.T) {
+	l := newRateLimiter(&RateLimit{DocsPerSecond: 10, Adaptive: true, MaxQueue: 5, MaxLag: time.Second})
+
+	assert.True(t, l.loaded(serverLoad{queue: 6}))
+	assert.True(t, l.loaded(serverLoad{lag: 2 * time.Second}))
+	assert.False(t, l.loaded(serverLoad{queue: 5, lag: time.Second}))
+
+	assert.Equal(t, 0.5, l.adapt(true))
+	assert.Equal(t, 0.25, l.adapt(true))
+	for i := 0; i < 10; i++ {
+		l.adapt(true)
+	}
+	assert.Equal(t, minRateFactor, l.factor)
+	assert.Equal(t, 2*minRateFactor, l.adapt(false))
+	for i := 0; i < 10; i++ {
+		l.adapt(false)
+	}
+	assert.Equal(t, 1.0, l.factor)
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	assert.Nil(t, newRateLimiter(nil))
+	assert.Nil(t, newRateLimiter(&RateLimit{}))
+	// A nil limiter never waits.
+	(*rateLimiter)(nil).wait(1 << 20)
+}
+
+func TestRateLimitValidate(t *testing.T) {
+	assert.NoError(t, (*RateLimit)(nil).Validate())
+	assert.NoError(t, (&RateLimit{DocsPerSecond: 100, Adaptive: true, MaxQueue: 10}).Validate())
+	assert.Error(t, (&RateLimit{DocsPerSecond: -1}).Validate())
+	assert.Error(t, (&RateLimit{Adaptive: true, MaxQueue: 10}).Validate())
+	assert.Error(t, (&RateLimit{BytesPerSecond: 100, Adaptive: true}).Validate())
+}
+
+func TestMaxLag(t *testing.T) {
+	now := time.Now()
+	members := []replicaSetMember{
+		{Name: "a", State: stateSecondary, OptimeDate: now.Add(-3 * time.Second)},
+		{Name: "b", State: statePrimary, OptimeDate: now},
+		{Name: "c", State: stateSecondary, OptimeDate: now.Add(-time.Second)},
+		{Name: "d", State: 8, OptimeDate: now.Add(-time.Hour)},
+	}
+	assert.Equal(t, 3*time.Second, maxLag(members))
+	l, known := lag(members, members[2])
+	assert.True(t, known)
+	assert.Equal(t, time.Second, l)
+	_, known = lag(members[:1], members[0])
+	assert.False(t, known)
+	assert.Equal(t, time.Duration(0), maxLag(members[:1]))
+}
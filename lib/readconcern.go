@@ -0,0 +1,289 @@
+package mongodb
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Read concern levels. Without one, the default of the server applies.
+const (
+	// ReadConcernLocal reads the most recent data of the member, which may be rolled back.
+	ReadConcernLocal = "local"
+	// ReadConcernMajority reads data acknowledged by a majority of the replica set.
+	ReadConcernMajority = "majority"
+	// ReadConcernSnapshot reads every collection of a run at the same cluster time, so that the
+	// export reflects a single moment. Requires MongoDB 5.0.
+	ReadConcernSnapshot = "snapshot"
+)
+
+func ValidateReadConcern(level string) error {
+	switch level {
+	case "", ReadConcernLocal, ReadConcernMajority, ReadConcernSnapshot:
+		return nil
+	}
+	return fmt.Errorf("unknown read concern %q, expected %q, %q or %q", level, ReadConcernLocal, ReadConcernMajority, ReadConcernSnapshot)
+}
+
+// Timestamp is a cluster time of MongoDB, e.g. to start streaming the oplog from.
+type Timestamp struct {
+	// T is the number of seconds since the epoch.
+	T uint32 `json:"t"`
+	// I orders operations within the same second.
+	I uint32 `json:"i"`
+}
+
+func newTimestamp(ts bson.MongoTimestamp) *Timestamp {
+	return &Timestamp{T: uint32(ts >> 32), I: uint32(ts)}
+}
+
+func (t *Timestamp) mongo() bson.MongoTimestamp {
+	return bson.MongoTimestamp(int64(t.T)<<32 | int64(t.I))
+}
+
+// Returns the current cluster time of the server, or 0 if it does not report one, e.g. it is a
+// standalone server or older than MongoDB 3.6.
+func (m *MongoDB) clusterTime() (bson.MongoTimestamp, error) {
+	var result struct {
+		OperationTime bson.MongoTimestamp `bson:"operationTime"`
+	}
+	if err := m.db.Run(bson.D{{Name: "ping", Value: 1}}, &result); err != nil {
+		return 0, err
+	}
+	return result.OperationTime, nil
+}
+
+// Sets the read concern of the scans of a run. Snapshot reads are pinned to the current cluster
+// time, and fall back to majority reads on servers without one.
+func (m *MongoDB) pinReadConcern(level string, report *Report) error {
+	if level == "" {
+		return nil
+	}
+	rc := bson.D{{Name: "level", Value: level}}
+	if level == ReadConcernSnapshot {
+		ts, err := m.clusterTime()
+		if err != nil {
+			return err
+		}
+		if ts == 0 {
+			logrus.Warn("The server reports no cluster time, reading with majority read concern instead of a snapshot")
+			level = ReadConcernMajority
+			rc = bson.D{{Name: "level", Value: level}}
+		} else {
+			rc = append(rc, bson.DocElem{Name: "atClusterTime", Value: ts})
+			report.recordSnapshot(newTimestamp(ts))
+		}
+	}
+	report.recordReadConcern(level)
+	m.readConcern = rc
+	logrus.WithField("read_concern", rc).Info("Read concern set")
+	return nil
+}
+
+// How long servers keep the history snapshot reads need by default, see snapshotWindow.
+const defaultSnapshotWindow = 5 * time.Minute
+
+// Optimistic read throughput of a single cursor in bytes per second, to estimate how long scans are
+// likely to take.
+const cursorThroughput = 100 << 20
+
+// Returns how long the server keeps the history snapshot reads need. Reads of a snapshot older than
+// that fail with SnapshotTooOld.
+func (m *MongoDB) snapshotWindow() time.Duration {
+	var result struct {
+		Seconds int `bson:"minSnapshotHistoryWindowInSeconds"`
+	}
+	cmd := bson.D{{Name: "getParameter", Value: 1}, {Name: "minSnapshotHistoryWindowInSeconds", Value: 1}}
+	if err := m.db.Session.DB("admin").Run(cmd, &result); err != nil || result.Seconds <= 0 {
+		return defaultSnapshotWindow
+	}
+	return time.Duration(result.Seconds) * time.Second
+}
+
+// Number of documents and BSON bytes of a collection.
+type collectionSize struct {
+	Count int64 `bson:"count"`
+	Size  int64 `bson:"size"`
+}
+
+// Returns the sizes of the collections read by the scans. Virtual collections read their source,
+// and views have no size of their own, so they are left out.
+func (m *MongoDB) collectionSizes(collections []*Collection) []collectionSize {
+	seen := make(map[string]bool)
+	var sizes []collectionSize
+	for _, c := range collections {
+		name := c.CollectionName
+		if c.IsVirtual() {
+			name = c.Source
+		}
+		if seen[name] || c.Kind == KindView {
+			continue
+		}
+		seen[name] = true
+
+		var size collectionSize
+		if err := m.db.Run(bson.D{{Name: "collStats", Value: name}}, &size); err != nil {
+			logrus.WithError(err).WithField("collection", name).Debug("Unable to read the size of the collection")
+			continue
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes
+}
+
+// Returns how long scanning collections of the given sizes takes at least under the rate limits,
+// which all the scans share, and how long it likely takes with that many concurrent cursors reading
+// at cursorThroughput each.
+func scanDurations(sizes []collectionSize, concurrency int, limit *RateLimit) (min, likely time.Duration) {
+	var count, total, largest int64
+	for _, size := range sizes {
+		count += size.Count
+		total += size.Size
+		if size.Size > largest {
+			largest = size.Size
+		}
+	}
+
+	seconds := func(amount int64, rate float64) time.Duration {
+		return time.Duration(float64(amount) / rate * float64(time.Second))
+	}
+	if limit != nil && limit.DocsPerSecond > 0 {
+		min = seconds(count, limit.DocsPerSecond)
+	}
+	if limit != nil && limit.BytesPerSecond > 0 {
+		if d := seconds(total, limit.BytesPerSecond); d > min {
+			min = d
+		}
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	// The largest collection is read by a single cursor, however many others run alongside it.
+	likely = seconds(total, float64(concurrency)*cursorThroughput)
+	if d := seconds(largest, cursorThroughput); d > likely {
+		likely = d
+	}
+	if min > likely {
+		likely = min
+	}
+	return min, likely
+}
+
+// Checks that the scans can finish before the snapshot they read falls out of the history of the
+// server. Fails if the rate limits make it impossible, and warns if they are likely to take longer.
+func (m *MongoDB) checkSnapshotWindow(collections []*Collection, concurrency int, limit *RateLimit) error {
+	window := m.snapshotWindow()
+	min, likely := scanDurations(m.collectionSizes(collections), concurrency, limit)
+	if min > window {
+		return fmt.Errorf("the rate limits let the scans finish in %v at best, after the snapshot window of %v; raise minSnapshotHistoryWindowInSeconds or the rate limits, or use another read concern", min, window)
+	}
+	if likely > window {
+		logrus.WithFields(logrus.Fields{"estimate": likely, "window": window}).Warn("The scans will likely outlast the snapshot window and fail with SnapshotTooOld")
+	}
+	return nil
+}
+
+// Returns the fields to sort the documents of a collection by.
+func sortFields(c *Collection, opts *CursorOptions, byID bool) []string {
+	switch {
+	case len(opts.Sort) > 0:
+		return opts.Sort
+	case byID:
+		return []string{"_id"}
+	case c.Kind == KindCapped:
+		return []string{"$natural"}
+	case c.Kind == KindTimeSeries && c.timeField != "":
+		return []string{c.timeField}
+	}
+	return nil
+}
+
+// Returns the key document of a list of fields, prefixed with `-` for descending order.
+func keyDocument(fields []string) bson.D {
+	var key bson.D
+	for _, field := range fields {
+		order := 1
+		switch {
+		case strings.HasPrefix(field, "-"):
+			order = -1
+			field = field[1:]
+		case strings.HasPrefix(field, "+"):
+			field = field[1:]
+		}
+		key = append(key, bson.DocElem{Name: field, Value: order})
+	}
+	return key
+}
+
+// Opens a cursor over the documents of a collection matching the filter.
+func (m *MongoDB) openFind(db *mgo.Database, c *Collection, opts *CursorOptions, filter bson.M, fieldsToInclude map[string]interface{}, byID bool) *mgo.Iter {
+	if m.readConcern == nil {
+		return find(db, c, opts, filter, fieldsToInclude, byID).Iter()
+	}
+
+	// The driver has no read concern option, so the command is run as such.
+	cmd := bson.D{{Name: "find", Value: c.CollectionName}}
+	if len(filter) > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "filter", Value: filter})
+	}
+	if fieldsToInclude != nil {
+		cmd = append(cmd, bson.DocElem{Name: "projection", Value: fieldsToInclude})
+	}
+	if sort := sortFields(c, opts, byID); len(sort) > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "sort", Value: keyDocument(sort)})
+	}
+	if len(opts.Hint) > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "hint", Value: keyDocument(opts.Hint)})
+	}
+	if opts.BatchSize > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "batchSize", Value: opts.BatchSize})
+	}
+	if opts.MaxTimeMS > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: opts.MaxTimeMS})
+	}
+	if opts.noCursorTimeout() {
+		cmd = append(cmd, bson.DocElem{Name: "noCursorTimeout", Value: true})
+	}
+	return m.runCursorCommand(db, c.CollectionName, cmd)
+}
+
+// Opens a cursor over the results of an aggregation pipeline.
+func (m *MongoDB) openPipe(db *mgo.Database, collectionName string, pipeline []bson.D, opts *CursorOptions) *mgo.Iter {
+	if m.readConcern == nil {
+		return opts.applyPipe(db.C(collectionName).Pipe(pipeline).AllowDiskUse()).Iter()
+	}
+
+	cursor := bson.D{}
+	if opts.BatchSize > 0 {
+		cursor = append(cursor, bson.DocElem{Name: "batchSize", Value: opts.BatchSize})
+	}
+	return m.runCursorCommand(db, collectionName, bson.D{
+		{Name: "aggregate", Value: collectionName},
+		{Name: "pipeline", Value: pipeline},
+		{Name: "cursor", Value: cursor},
+		{Name: "allowDiskUse", Value: true},
+	})
+}
+
+// Runs a command returning a cursor with the read concern of the run, and iterates over it.
+func (m *MongoDB) runCursorCommand(db *mgo.Database, collectionName string, cmd bson.D) *mgo.Iter {
+	cmd = append(cmd, bson.DocElem{Name: "readConcern", Value: m.readConcern})
+
+	var result struct {
+		Cursor struct {
+			FirstBatch []bson.Raw `bson:"firstBatch"`
+			NS         string     `bson:"ns"`
+			ID         int64      `bson:"id"`
+		} `bson:"cursor"`
+	}
+	err := db.Run(cmd, &result)
+	if ns := strings.SplitN(result.Cursor.NS, ".", 2); len(ns) == 2 {
+		return db.Session.DB(ns[0]).C(ns[1]).NewIter(nil, result.Cursor.FirstBatch, result.Cursor.ID, err)
+	}
+	return db.C(collectionName).NewIter(nil, result.Cursor.FirstBatch, result.Cursor.ID, err)
+}
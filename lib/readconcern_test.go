@@ -0,0 +1,72 @@
+package mongodb
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestValidateReadConcern(t *testing.T) {
+	for _, level := range []string{"", ReadConcernLocal, ReadConcernMajority, ReadConcernSnapshot} {
+		assert.NoError(t, ValidateReadConcern(level), level)
+	}
+	assert.Error(t, ValidateReadConcern("linearizable"))
+}
+
+func TestSortFields(t *testing.T) {
+	opts := &CursorOptions{}
+	assert.Equal(t, []string{"_id"}, sortFields(&Collection{}, opts, true))
+	assert.Nil(t, sortFields(&Collection{}, opts, false))
+	assert.Equal(t, []string{"$natural"}, sortFields(&Collection{Kind: KindCapped}, opts, false))
+	assert.Equal(t, []string{"ts"}, sortFields(&Collection{Kind: KindTimeSeries, timeField: "ts"}, opts, false))
+	assert.Equal(t, []string{"-created_at"}, sortFields(&Collection{}, &CursorOptions{Sort: []string{"-created_at"}}, true))
+}
+
+func TestKeyDocument(t *testing.T) {
+	assert.Equal(t, bson.D{
+		{Name: "created_at", Value: -1},
+		{Name: "name", Value: 1},
+		{Name: "_id", Value: 1},
+	}, keyDocument([]string{"-created_at", "+name", "_id"}))
+}
+
+func TestReportClusterTime(t *testing.T) {
+	ts := bson.MongoTimestamp(1468540800<<32 | 7)
+	assert.Equal(t, &Timestamp{T: 1468540800, I: 7}, newTimestamp(ts))
+	assert.Equal(t, ts, newTimestamp(ts).mongo())
+
+	report := NewReport("test")
+	report.recordReadConcern(ReadConcernSnapshot)
+	report.recordSnapshot(newTimestamp(ts))
+	b, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "snapshot", decoded["read_concern"])
+	assert.Equal(t, map[string]interface{}{"t": 1468540800.0, "i": 7.0}, decoded["cluster_time"])
+}
+
+func TestScanDurations(t *testing.T) {
+	sizes := []collectionSize{{Count: 1000, Size: 400 << 20}, {Count: 3000, Size: 200 << 20}}
+
+	// Without rate limits, the largest collection bounds the time even with many cursors.
+	min, likely := scanDurations(sizes, 4, nil)
+	assert.Equal(t, time.Duration(0), min)
+	assert.Equal(t, 4*time.Second, likely)
+
+	// With a single cursor, the collections are read one after the other.
+	_, likely = scanDurations(sizes, 1, nil)
+	assert.Equal(t, 6*time.Second, likely)
+
+	// The rate limits are shared by all the scans, so concurrency does not make them faster.
+	min, likely = scanDurations(sizes, 4, &RateLimit{DocsPerSecond: 10, BytesPerSecond: 1 << 20})
+	assert.Equal(t, 10*time.Minute, min)
+	assert.Equal(t, 10*time.Minute, likely)
+}
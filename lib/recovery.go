@@ -0,0 +1,167 @@
+package mongodb
+
+import (
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cenkalti/backoff"
+	"github.com/segmentio/objects-go"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Server error codes after which a cursor can be opened again, e.g. on the new primary.
+var retryableCodes = map[int]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	43:    true, // CursorNotFound
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	9001:  true, // SocketException
+	10107: true, // NotMaster
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotMasterNoSlaveOk
+	13436: true, // NotMasterOrSecondary
+}
+
+// Messages of errors the driver reports without a code.
+var retryableMessages = []string{
+	"not master",
+	"no reachable servers",
+	"closed explicitly",
+	"connection reset",
+	"broken pipe",
+	"cursor not found",
+}
+
+// Reports whether a scan failing with the error may be resumed.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF || err == mgo.ErrCursor || err == errSecondaryLags {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	switch e := err.(type) {
+	case *mgo.QueryError:
+		if retryableCodes[e.Code] {
+			return true
+		}
+	case *mgo.LastError:
+		if retryableCodes[e.Code] {
+			return true
+		}
+	}
+	message := strings.ToLower(err.Error())
+	for _, m := range retryableMessages {
+		if strings.Contains(message, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Progress of the scan of a cursor, kept across attempts.
+type cursorProgress struct {
+	// Documents published.
+	documents int
+	// `_id` of the last document published.
+	lastID interface{}
+}
+
+// Returns a filter matching the documents of the filter that come after the given `_id` in `_id`
+// order, including those whose `_id` is of a type sorting after the one of the given `_id`.
+func resumeFilter(filter bson.M, after interface{}) bson.M {
+	if after == nil {
+		return filter
+	}
+	condition := compareFilter("_id", "$gt", after)
+	if len(filter) == 0 {
+		return condition
+	}
+	return bson.M{"$and": []bson.M{filter, condition}}
+}
+
+// Reports whether a scan of the collection can be resumed after the last `_id` published, which
+// requires documents to be read in `_id` order. Other scans are restarted from the beginning. A
+// hint on another index would have the `_id` order sorted in memory, so it is left to the default
+// order of the index instead.
+func (c *Collection) resumable(opts *CursorOptions) bool {
+	if len(opts.Hint) > 0 && !(len(opts.Hint) == 1 && strings.TrimPrefix(opts.Hint[0], "+") == "_id") {
+		return false
+	}
+	return !c.IsVirtual() && c.Kind == "" && len(opts.Sort) == 0
+}
+
+// Returns the database to read from for an attempt of a scan, and the throttle of the reads from it.
+// Attempts after the first one, which retry a failed cursor, may read from another member.
+type connectFunc func(retry bool) (*mgo.Database, func(size int) error, error)
+
+// Scans a cursor, opening it again when it fails with a retryable error until the time allowed
+// for retries elapsed, or when the secondary it reads from lags too much. Each attempt gets a fresh session, so that a new primary is found after a
+// stepdown. Resumable cursors are opened after the last `_id` published, others from the start;
+// documents published twice are simply upserted again.
+func (m *MongoDB) scanWithRecovery(c *Collection, opts *CursorOptions, resumable bool, connect connectFunc, open func(db *mgo.Database, after interface{}) *mgo.Iter, publish func(o *objects.Object)) (int, error) {
+	progress := &cursorProgress{}
+	attempt := func(retry bool) error {
+		db, throttle, err := connect(retry)
+		if err != nil {
+			return err
+		}
+		session := db.Session.Copy()
+		defer session.Close()
+		session.Refresh()
+		// Cursors without a timeout are a setting of the session.
+		if opts.noCursorTimeout() {
+			session.SetCursorTimeout(0)
+		}
+
+		var after interface{}
+		if resumable {
+			after = progress.lastID
+		}
+		return m.scanIter(c, open(db.With(session), after), throttle, publish, progress)
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = m.retryMaxElapsed
+	b.Reset()
+	for retry := false; ; retry = true {
+		before := progress.documents
+		err := attempt(retry)
+		// Switching to another secondary is not a failure, the scan goes on from it right away.
+		if err == errSecondaryLags {
+			continue
+		}
+		if m.retryMaxElapsed <= 0 || !isRetryable(err) {
+			return progress.documents, err
+		}
+		// Only consecutive failures count towards the time allowed for retries.
+		if progress.documents > before {
+			b.Reset()
+		}
+		next := b.NextBackOff()
+		if next == backoff.Stop {
+			return progress.documents, err
+		}
+
+		fields := logrus.Fields{
+			"collection": c.CollectionName,
+			"documents":  progress.documents,
+			"retry_in":   next,
+		}
+		if resumable {
+			fields["after"] = progress.lastID
+		}
+		logrus.WithError(err).WithFields(fields).Warn("Cursor failed, opening it again")
+		time.Sleep(next)
+	}
+}
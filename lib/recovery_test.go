@@ -0,0 +1,54 @@
+package mongodb
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, isRetryable(io.EOF))
+	assert.True(t, isRetryable(mgo.ErrCursor))
+	assert.True(t, isRetryable(&mgo.QueryError{Code: 43, Message: "cursor id 123 not found"}))
+	assert.True(t, isRetryable(&mgo.QueryError{Code: 11602, Message: "operation was interrupted"}))
+	assert.True(t, isRetryable(&mgo.LastError{Code: 10107, Err: "not master"}))
+	assert.True(t, isRetryable(errors.New("no reachable servers")))
+	assert.True(t, isRetryable(errors.New("Closed explicitly")))
+
+	assert.False(t, isRetryable(nil))
+	assert.False(t, isRetryable(&mgo.QueryError{Code: 2, Message: "bad value"}))
+	assert.False(t, isRetryable(errors.New("_id of unsupported type")))
+}
+
+func TestResumeFilter(t *testing.T) {
+	assert.Nil(t, resumeFilter(nil, nil))
+	id := bson.ObjectIdHex("57881f9ce8414cf291b44b4e")
+	after := bson.M{"$or": []bson.M{
+		{"_id": bson.M{"$gt": id}},
+		{"_id": bson.M{"$type": []string{"bool", "date", "timestamp", "regex", "maxKey"}}},
+	}}
+	assert.Equal(t, after, resumeFilter(nil, id))
+	assert.Equal(t, bson.M{"$and": []bson.M{
+		{"user_id": bson.M{"$gte": 10}},
+		after,
+	}}, resumeFilter(bson.M{"user_id": bson.M{"$gte": 10}}, id))
+
+	// Documents whose `_id` is of a type sorting after numbers are not skipped.
+	assert.Equal(t, bson.M{"$or": []bson.M{
+		{"_id": bson.M{"$gt": 42}},
+		{"_id": bson.M{"$type": []string{"string", "symbol", "object", "array", "binData", "objectId", "bool", "date", "timestamp", "regex", "maxKey"}}},
+	}}, resumeFilter(nil, 42))
+}
+
+func TestCollectionResumable(t *testing.T) {
+	assert.True(t, (&Collection{}).resumable(&CursorOptions{}))
+	assert.True(t, (&Collection{}).resumable(&CursorOptions{Hint: []string{"_id"}}))
+	assert.False(t, (&Collection{}).resumable(&CursorOptions{Hint: []string{"created_at"}}))
+	assert.False(t, (&Collection{}).resumable(&CursorOptions{Sort: []string{"-created_at"}}))
+	assert.False(t, (&Collection{Kind: KindCapped}).resumable(&CursorOptions{}))
+	assert.False(t, (&Collection{Kind: KindView}).resumable(&CursorOptions{}))
+}
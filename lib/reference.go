@@ -0,0 +1,249 @@
+package mongodb
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Number of documents scanned before the references they hold are resolved together.
+const referenceBatchSize = 500
+
+// Maximum number of referenced documents kept in the cache of a reference. The cache is simply
+// cleared when it is full, but for the documents of the batches being published, which is good
+// enough since documents referring to the same one tend to be close to each other.
+const referenceCacheSize = 100000
+
+// Reference denormalizes the document a field refers to: the fields of the referenced document are
+// published as properties of the referring one, like a `$lookup` would.
+type Reference struct {
+	// Collection holding the referenced documents.
+	Collection string `json:"collection"`
+	// Key is the field of the referenced documents the value of the referring field is matched
+	// against. Defaults to `_id`.
+	Key string `json:"key,omitempty"`
+	// Fields of the referenced document to publish. Destination names default to the destination
+	// name of the referring field and the name of the referenced field, e.g. `user_id.email`.
+	Fields map[string]*Field `json:"fields"`
+
+	mu sync.Mutex
+	// Referenced documents by cacheKey of their key.
+	cache map[interface{}]map[string]interface{}
+	// Number of batches being published referring to each value, whose documents must stay cached.
+	pinned map[interface{}]int
+}
+
+func (r *Reference) key() string {
+	if r.Key == "" {
+		return "_id"
+	}
+	return r.Key
+}
+
+func (r *Reference) init(field *Field) {
+	for fieldName, f := range r.Fields {
+		if f == nil {
+			f = &Field{}
+			r.Fields[fieldName] = f
+		}
+		f.FieldName = fieldName
+		if f.DestinationName == "" {
+			f.DestinationName = field.destinationName() + "." + fieldName
+		}
+	}
+	r.cache = make(map[interface{}]map[string]interface{})
+	r.pinned = make(map[interface{}]int)
+}
+
+func (r *Reference) validate(field *Field) error {
+	if r.Collection == "" {
+		return fmt.Errorf("field %q: reference requires a collection", field.FieldName)
+	}
+	if isPattern(field.FieldName) {
+		return fmt.Errorf("field %q: wildcard fields cannot be references", field.FieldName)
+	}
+	for _, f := range r.Fields {
+		if f.Reference != nil {
+			return fmt.Errorf("field %q: references cannot be nested", field.FieldName)
+		}
+		if err := f.validate(); err != nil {
+			return fmt.Errorf("field %q: reference: %v", field.FieldName, err)
+		}
+	}
+	return nil
+}
+
+// Returns the referenced document from the cache, or nil if it is unknown or does not exist.
+func (r *Reference) lookup(value interface{}) map[string]interface{} {
+	key, ok := cacheKey(value)
+	if !ok {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cache[key]
+}
+
+// Fetches the referenced documents that are not cached yet with a single query, with the read
+// concern of the run. The documents of the values stay cached until they are released, once the
+// batch referring to them is published. Returns the keys to release.
+func (r *Reference) resolve(m *MongoDB, values []interface{}) ([]interface{}, error) {
+	r.mu.Lock()
+	pinned := make([]interface{}, 0, len(values))
+	missing := make([]interface{}, 0, len(values))
+	seen := make(map[interface{}]bool, len(values))
+	for _, value := range values {
+		key, ok := cacheKey(value)
+		if !ok || seen[key] {
+			continue
+		}
+		seen[key] = true
+		r.pinned[key]++
+		pinned = append(pinned, key)
+		if _, ok := r.cache[key]; !ok {
+			missing = append(missing, value)
+		}
+	}
+	r.mu.Unlock()
+
+	if len(missing) == 0 {
+		return pinned, nil
+	}
+	if err := r.fetch(m, missing); err != nil {
+		r.release(pinned)
+		return nil, err
+	}
+	return pinned, nil
+}
+
+// Fetches referenced documents into the cache.
+func (r *Reference) fetch(m *MongoDB, missing []interface{}) error {
+	fieldsToInclude := map[string]interface{}{r.key(): 1}
+	for fieldName := range r.Fields {
+		fieldsToInclude[fieldName] = 1
+	}
+
+	found := make(map[interface{}]map[string]interface{}, len(missing))
+	filter := bson.M{r.key(): bson.M{"$in": missing}}
+	iter := m.openFind(m.db, &Collection{CollectionName: r.Collection}, &CursorOptions{}, filter, projectPaths(keys(fieldsToInclude)), false)
+	var doc map[string]interface{}
+	for iter.Next(&doc) {
+		if key, ok := cacheKey(getForNestedKey(doc, r.key())); ok {
+			found[key] = doc
+		}
+		doc = nil
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	r.store(missing, found)
+	return nil
+}
+
+// Caches the documents found, by key, for the values looked up, making room for them if needed.
+func (r *Reference) store(missing []interface{}, found map[interface{}]map[string]interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache)+len(missing) > referenceCacheSize {
+		cache := make(map[interface{}]map[string]interface{}, len(r.pinned)+len(missing))
+		for value := range r.pinned {
+			if doc, ok := r.cache[value]; ok {
+				cache[value] = doc
+			}
+		}
+		r.cache = cache
+	}
+	// Documents that were not found are cached too, so they are not looked up again.
+	for _, value := range missing {
+		key, _ := cacheKey(value)
+		r.cache[key] = found[key]
+	}
+}
+
+// Lets the cache evict the documents of keys returned by resolve.
+func (r *Reference) release(keys []interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range keys {
+		if r.pinned[key]--; r.pinned[key] <= 0 {
+			delete(r.pinned, key)
+		}
+	}
+}
+
+// Returns the key of a value in the cache, and false if it cannot be looked up, e.g. it is a
+// sub-document. Numbers of all types match each other in queries, so whole numbers are keyed as
+// int64 and others as float64, whatever their type.
+func cacheKey(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case string, bson.ObjectId, bool:
+		return v, true
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 {
+			return int64(v), true
+		}
+		return v, true
+	}
+	return nil, false
+}
+
+func keys(m map[string]interface{}) []string {
+	out := make([]string, 0, len(m))
+	for key := range m {
+		out = append(out, key)
+	}
+	return out
+}
+
+// Resolves the references of the fields of the collection for a batch of documents. Returns a
+// function releasing the referenced documents once the batch is published.
+func (m *MongoDB) resolveReferences(c *Collection, batch []map[string]interface{}) (func(), error) {
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for fieldName, field := range c.Fields {
+		if field == nil || field.Reference == nil {
+			continue
+		}
+
+		values := make([]interface{}, 0, len(batch))
+		for _, result := range batch {
+			if value := getForNestedKey(result, fieldName); value != nil {
+				values = append(values, value)
+			}
+		}
+		reference := field.Reference
+		pinned, err := reference.resolve(m, values)
+		if err != nil {
+			release()
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"collection": c.CollectionName,
+				"field":      fieldName,
+				"reference":  reference.Collection,
+			}).Error("Unable to resolve references")
+			return nil, err
+		}
+		releases = append(releases, func() { reference.release(pinned) })
+	}
+	return release, nil
+}
+
+// Adds the properties of the document referenced by the value of the field.
+func setReferenceProperties(properties map[string]interface{}, value interface{}, field *Field) {
+	doc := field.Reference.lookup(value)
+	for fieldName, f := range field.Reference.Fields {
+		setProperty(properties, f.destinationName(), getForNestedKey(doc, fieldName), f)
+	}
+}
@@ -0,0 +1,111 @@
+package mongodb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const referenceSchema = `{"test": {"orders": {"fields": {
+	"total": null,
+	"user_id": {"reference": {"collection": "users", "fields": {
+		"email": {"transform": "mask", "length": 4},
+		"plan.name": {"destination_name": "plan"}
+	}}}
+}}}}`
+
+func TestParseSchemaReference(t *testing.T) {
+	desc, err := NewDescriptionFromReader(strings.NewReader(referenceSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := desc.schemas["test"]["orders"]
+	r := c.Fields["user_id"].Reference
+
+	assert.True(t, c.hasReferences())
+	assert.Equal(t, "users", r.Collection)
+	assert.Equal(t, "_id", r.key())
+	assert.Equal(t, "user_id.email", r.Fields["email"].destinationName())
+	assert.Equal(t, "plan", r.Fields["plan.name"].destinationName())
+}
+
+func TestGetPropertiesWithReference(t *testing.T) {
+	desc, err := NewDescriptionFromReader(strings.NewReader(referenceSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := desc.schemas["test"]["orders"]
+	r := c.Fields["user_id"].Reference
+
+	// Documents resolved by a previous batch are served from the cache.
+	r.cache["u1"] = map[string]interface{}{"_id": "u1", "email": "ada@example.com", "plan": map[string]interface{}{"name": "pro"}}
+	r.cache["u2"] = nil
+
+	properties := getPropertiesMapFromResult(map[string]interface{}{"_id": "o1", "total": 10, "user_id": "u1"}, c)
+	assert.Equal(t, map[string]interface{}{
+		"total":         10,
+		"user_id":       "u1",
+		"user_id.email": "***********.com",
+		"plan":          "pro",
+	}, properties)
+
+	properties = getPropertiesMapFromResult(map[string]interface{}{"_id": "o2", "total": 5, "user_id": "u2"}, c)
+	assert.Equal(t, map[string]interface{}{"total": 5, "user_id": "u2"}, properties)
+}
+
+func TestReferenceCacheEvictionKeepsPinned(t *testing.T) {
+	r := &Reference{Collection: "users"}
+	r.init(&Field{FieldName: "user_id"})
+	for i := 0; i < referenceCacheSize; i++ {
+		r.cache[int64(i)] = map[string]interface{}{"_id": i}
+	}
+
+	// The batch refers to a cached document and to one that is fetched, which overflows the cache.
+	pinned, err := r.resolve(nil, []interface{}{1})
+	assert.NoError(t, err)
+	r.pinned["u1"]++
+	pinned = append(pinned, "u1")
+	r.store([]interface{}{"u1"}, map[interface{}]map[string]interface{}{"u1": {"_id": "u1"}})
+
+	assert.Len(t, r.cache, 2)
+	assert.Equal(t, map[string]interface{}{"_id": 1}, r.lookup(1))
+	assert.Equal(t, map[string]interface{}{"_id": "u1"}, r.lookup("u1"))
+
+	r.release(pinned)
+	assert.Empty(t, r.pinned)
+}
+
+func TestReferenceCacheKey(t *testing.T) {
+	for _, value := range []interface{}{"u1", int64(1), true} {
+		key, ok := cacheKey(value)
+		assert.True(t, ok)
+		assert.Equal(t, value, key)
+	}
+	for _, value := range []interface{}{nil, map[string]interface{}{"a": 1}, []interface{}{1}} {
+		_, ok := cacheKey(value)
+		assert.False(t, ok)
+	}
+
+	// Numbers match across types, like in queries.
+	for _, value := range []interface{}{5, int32(5), int64(5), 5.0} {
+		key, _ := cacheKey(value)
+		assert.Equal(t, int64(5), key)
+	}
+	key, _ := cacheKey(5.5)
+	assert.Equal(t, 5.5, key)
+}
+
+func TestReferenceMixedNumberTypes(t *testing.T) {
+	r := &Reference{Collection: "users"}
+	r.init(&Field{FieldName: "user_id"})
+
+	// `orders.user_id` holds doubles while `users._id` holds int32s, which mgo decodes as ints.
+	doc := map[string]interface{}{"_id": 5, "plan": "pro"}
+	key, _ := cacheKey(doc["_id"])
+	r.store([]interface{}{5.0, 6.0}, map[interface{}]map[string]interface{}{key: doc})
+
+	assert.Equal(t, doc, r.lookup(5.0))
+	assert.Equal(t, doc, r.lookup(5))
+	assert.Nil(t, r.lookup(6.0))
+}
@@ -0,0 +1,60 @@
+package mongodb
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// States of replica set members, as reported by `replSetGetStatus`.
+const (
+	statePrimary   = 1
+	stateSecondary = 2
+)
+
+// Member of a replica set, as reported by `replSetGetStatus`.
+type replicaSetMember struct {
+	Name       string    `bson:"name"`
+	State      int       `bson:"state"`
+	OptimeDate time.Time `bson:"optimeDate"`
+	Self       bool      `bson:"self"`
+}
+
+// Returns the members of the replica set of the server.
+func (m *MongoDB) replicaSetMembers() ([]replicaSetMember, error) {
+	var status struct {
+		Members []replicaSetMember `bson:"members"`
+	}
+	if err := m.db.Session.Run(bson.D{{Name: "replSetGetStatus", Value: 1}}, &status); err != nil {
+		return nil, err
+	}
+	return status.Members, nil
+}
+
+// Returns how far behind the primary the given member is, and false if it is unknown because there
+// is no primary, e.g. during an election, which is when members are the most likely to be stale.
+func lag(members []replicaSetMember, member replicaSetMember) (time.Duration, bool) {
+	for _, primary := range members {
+		if primary.State == statePrimary {
+			if lag := primary.OptimeDate.Sub(member.OptimeDate); lag > 0 {
+				return lag, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// Returns the replication lag of the slowest secondary, 0 if it is unknown.
+func maxLag(members []replicaSetMember) time.Duration {
+	var max time.Duration
+	for _, member := range members {
+		if member.State != stateSecondary {
+			continue
+		}
+		if l, _ := lag(members, member); l > max {
+			max = l
+		}
+	}
+	return max
+}
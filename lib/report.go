@@ -0,0 +1,213 @@
+package mongodb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Report summarizes a run. It is logged at the end of the run and saved as JSON if a path is
+// configured.
+type Report struct {
+	Database   string    `json:"database"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// ReadConcern of all the reads of the run.
+	ReadConcern string `json:"read_concern,omitempty"`
+	// ClusterTime every collection was read at with snapshot read concern.
+	ClusterTime *Timestamp `json:"cluster_time,omitempty"`
+	// Sink settings objects were delivered with.
+	Sink *SinkConfig `json:"sink,omitempty"`
+	// Deliveries of objects by destination collection.
+	Deliveries map[string]*DeliveryReport `json:"deliveries,omitempty"`
+	// Errors that failed the run: collections that could not be scanned, objects that could not be
+	// delivered.
+	Errors []string `json:"errors,omitempty"`
+	// Stream of the changes following the scans, if any.
+	Stream *StreamReport `json:"stream,omitempty"`
+	// ReplicationLag observed for each secondary while reading from secondaries, by member.
+	ReplicationLag map[string]*LagReport `json:"replication_lag,omitempty"`
+
+	mu sync.Mutex
+}
+
+// LagReport is the replication lag observed for a member of the replica set.
+type LagReport struct {
+	MaxSeconds  float64 `json:"max_seconds"`
+	LastSeconds float64 `json:"last_seconds"`
+	// Pauses counts the times reads from the member were paused because it lagged too much.
+	Pauses int `json:"pauses"`
+}
+
+func NewReport(database string) *Report {
+	return &Report{
+		Database:  database,
+		StartedAt: time.Now().UTC(),
+	}
+}
+
+func (r *Report) lagReport(member string) *LagReport {
+	if r.ReplicationLag == nil {
+		r.ReplicationLag = make(map[string]*LagReport)
+	}
+	report, ok := r.ReplicationLag[member]
+	if !ok {
+		report = &LagReport{}
+		r.ReplicationLag[member] = report
+	}
+	return report
+}
+
+func (r *Report) recordLag(member string, lag time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := r.lagReport(member)
+	report.LastSeconds = lag.Seconds()
+	if report.LastSeconds > report.MaxSeconds {
+		report.MaxSeconds = report.LastSeconds
+	}
+}
+
+func (r *Report) recordSink(config *SinkConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Sink = config
+}
+
+// Records the outcome of the deliveries, and an error for each collection with failed objects.
+func (r *Report) recordDeliveries(deliveries map[string]*DeliveryReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Deliveries = deliveries
+	var collections []string
+	for collection := range deliveries {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+	for _, collection := range collections {
+		if d := deliveries[collection]; d.Failed > 0 {
+			r.Errors = append(r.Errors, fmt.Sprintf("%d objects of %q were not delivered: %s", d.Failed, collection, d.LastError))
+		}
+	}
+}
+
+func (r *Report) recordError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Errors = append(r.Errors, err.Error())
+}
+
+// Returns an error summarizing the errors of the run, if any.
+func (r *Report) err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch len(r.Errors) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("run failed: %s", r.Errors[0])
+	}
+	return fmt.Errorf("run failed with %d errors, the first one: %s", len(r.Errors), r.Errors[0])
+}
+
+func (r *Report) recordReadConcern(level string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ReadConcern = level
+}
+
+func (r *Report) recordSnapshot(ts *Timestamp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ClusterTime = ts
+}
+
+func (r *Report) recordPause(member string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lagReport(member).Pauses++
+}
+
+// StreamReport is the progress of streaming the changes logged in the oplog.
+type StreamReport struct {
+	// From is the position of the oplog before the scans, changes are streamed from there.
+	From *Timestamp `json:"from"`
+	// Position of the last change streamed, to stream from next time.
+	Position *Timestamp `json:"position,omitempty"`
+	// Changes handled, and how many of them were skipped because the document was already
+	// exported with the same or a newer version.
+	Changes    int `json:"changes"`
+	Duplicates int `json:"duplicates"`
+}
+
+func (r *Report) recordStreamFrom(ts *Timestamp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Stream = &StreamReport{From: ts}
+}
+
+func (r *Report) recordStreamPosition(ts *Timestamp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Stream.Position = ts
+}
+
+func (r *Report) recordStreamEvent(published bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Stream.Changes++
+	if !published {
+		r.Stream.Duplicates++
+	}
+}
+
+// Finish records the end of the run.
+func (r *Report) Finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.FinishedAt = time.Now().UTC()
+}
+
+func (r *Report) MarshalJSON() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The alias has the same fields without the methods, so that it is encoded as a plain struct.
+	type report Report
+	return json.Marshal((*report)(r))
+}
+
+// Save writes the report as JSON, replacing the file atomically.
+func (r *Report) Save(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,182 @@
+package mongodb
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/segmentio/objects-go"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Minimum time between two progress reports of the scan of a shard.
+const shardProgressInterval = 30 * time.Second
+
+// Range of shard key values owned by a shard, as recorded in `config.chunks`.
+type chunk struct {
+	Min   bson.D `bson:"min"`
+	Max   bson.D `bson:"max"`
+	Shard string `bson:"shard"`
+}
+
+// Sharding metadata of a collection, as recorded in `config.collections`.
+type shardedCollection struct {
+	Key     bson.D      `bson:"key"`
+	Dropped bool        `bson:"dropped"`
+	UUID    interface{} `bson:"uuid"`
+}
+
+// Returns the shard key of a collection and its chunks by shard, or nil if the collection is not
+// sharded or cannot be scanned by range.
+func (m *MongoDB) shardChunks(c *Collection) (bson.D, map[string][]chunk, error) {
+	config := m.db.Session.DB("config")
+	ns := m.DBName + "." + c.CollectionName
+
+	var sharded shardedCollection
+	err := config.C("collections").FindId(ns).One(&sharded)
+	if err == mgo.ErrNotFound || (err == nil && sharded.Dropped) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, key := range sharded.Key {
+		if key.Value == "hashed" {
+			// Chunks of hashed shard keys are ranges of hashes, which queries cannot filter on.
+			logrus.WithField("collection", c.CollectionName).Warn("Collection has a hashed shard key, scanning through a single cursor")
+			return nil, nil, nil
+		}
+	}
+
+	// Chunks refer to their collection by namespace up to MongoDB 4.4, by UUID since 5.0.
+	query := bson.M{"ns": ns}
+	if sharded.UUID != nil {
+		query = bson.M{"$or": []bson.M{{"ns": ns}, {"uuid": sharded.UUID}}}
+	}
+	var chunks []chunk
+	if err := config.C("chunks").Find(query).Sort("min").All(&chunks); err != nil {
+		return nil, nil, err
+	}
+	return sharded.Key, groupChunks(chunks), nil
+}
+
+func groupChunks(chunks []chunk) map[string][]chunk {
+	byShard := make(map[string][]chunk)
+	for _, ch := range chunks {
+		byShard[ch.Shard] = append(byShard[ch.Shard], ch)
+	}
+	return byShard
+}
+
+// Scans the chunks of every shard in parallel, each through its own cursor on the router so that
+// orphaned documents left on shards by migrations are filtered out. Objects are published one at a
+// time.
+func (m *MongoDB) scanShards(c *Collection, opts *CursorOptions, resumable bool, key bson.D, chunks map[string][]chunk, fieldsToInclude map[string]interface{}, connect connectFunc, publish func(o *objects.Object)) error {
+	var mu sync.Mutex
+	publishOne := func(o *objects.Object) {
+		mu.Lock()
+		defer mu.Unlock()
+		publish(o)
+	}
+
+	shards := make([]string, 0, len(chunks))
+	for shard := range chunks {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	errs := make(chan error, len(shards))
+	var wg sync.WaitGroup
+	for _, shard := range shards {
+		wg.Add(1)
+		go func(shard string, chunks []chunk) {
+			defer wg.Done()
+			documents := 0
+			lastReport := time.Now()
+			for i, ch := range chunks {
+				filter := rangeFilter(key, ch.Min, ch.Max)
+				open := func(db *mgo.Database, after interface{}) *mgo.Iter {
+					return m.openFind(db, c, opts, resumeFilter(filter, after), fieldsToInclude, resumable)
+				}
+				n, err := m.scanWithRecovery(c, opts, resumable, connect, open, publishOne)
+				documents += n
+				if err != nil {
+					errs <- fmt.Errorf("collection %q, shard %q: %v", c.CollectionName, shard, err)
+					return
+				}
+				if i == len(chunks)-1 || time.Since(lastReport) >= shardProgressInterval {
+					lastReport = time.Now()
+					logrus.WithFields(logrus.Fields{
+						"collection": c.CollectionName,
+						"shard":      shard,
+						"chunks":     fmt.Sprintf("%d/%d", i+1, len(chunks)),
+						"documents":  documents,
+					}).Info("Shard scan progress")
+				}
+			}
+		}(shard, chunks[shard])
+	}
+	wg.Wait()
+	close(errs)
+
+	// Report the first error, the other shards were scanned anyway.
+	return <-errs
+}
+
+// Returns a filter matching the documents whose shard key is within [min, max). Compound shard
+// keys are compared field by field, and values of different types in the order of their types, the
+// way chunk ranges are; documents missing a field of the shard key are within the range of null.
+func rangeFilter(key bson.D, min, max bson.D) bson.M {
+	fields := make([]string, len(key))
+	for i, k := range key {
+		fields[i] = k.Name
+	}
+	lowerValues, upperValues := values(min), values(max)
+
+	// A range of a single field between values of the same type only holds values of that type.
+	if len(fields) == 1 && len(lowerValues) == 1 && len(upperValues) == 1 {
+		rank := bsonTypeRank(lowerValues[0])
+		if rank > 0 && rank < len(bsonTypeOrder)-1 && rank == bsonTypeRank(upperValues[0]) {
+			return bson.M{fields[0]: bson.M{"$gte": lowerValues[0], "$lt": upperValues[0]}}
+		}
+	}
+
+	lower := boundFilter(fields, lowerValues, "$gt", "$gte", bson.MinKey)
+	upper := boundFilter(fields, upperValues, "$lt", "$lt", bson.MaxKey)
+	switch {
+	case len(lower) == 0:
+		return upper
+	case len(upper) == 0:
+		return lower
+	}
+	return bson.M{"$and": []bson.M{lower, upper}}
+}
+
+// Returns a filter comparing the tuple of fields to the tuple of values, or an empty filter if any
+// tuple matches, i.e. the first value is the extreme one.
+func boundFilter(fields []string, vals []interface{}, op, lastOp string, extreme interface{}) bson.M {
+	if len(fields) == 0 || len(vals) == 0 || vals[0] == extreme {
+		return bson.M{}
+	}
+	if len(fields) == 1 || len(vals) == 1 {
+		return compareFilter(fields[0], lastOp, vals[0])
+	}
+
+	rest := boundFilter(fields[1:], vals[1:], op, lastOp, extreme)
+	equal := bson.M{fields[0]: vals[0]}
+	if len(rest) > 0 {
+		equal = bson.M{"$and": []bson.M{equal, rest}}
+	}
+	return bson.M{"$or": []bson.M{compareFilter(fields[0], op, vals[0]), equal}}
+}
+
+func values(d bson.D) []interface{} {
+	out := make([]interface{}, len(d))
+	for i, e := range d {
+		out[i] = e.Value
+	}
+	return out
+}
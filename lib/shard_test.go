@@ -0,0 +1,76 @@
+package mongodb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRangeFilterSingleField(t *testing.T) {
+	key := bson.D{{Name: "user_id", Value: 1}}
+
+	assert.Equal(t, bson.M{"user_id": bson.M{"$gte": 10, "$lt": 20}},
+		rangeFilter(key, bson.D{{Name: "user_id", Value: 10}}, bson.D{{Name: "user_id", Value: 20}}))
+	assert.Equal(t, bson.M{},
+		rangeFilter(key, bson.D{{Name: "user_id", Value: bson.MinKey}}, bson.D{{Name: "user_id", Value: bson.MaxKey}}))
+
+	// Null, missing and values of other types belong to the chunks their type sorts into.
+	assert.Equal(t, bson.M{"$or": []bson.M{
+		{"user_id": bson.M{"$lt": 20}},
+		{"user_id": bson.M{"$type": []string{"minKey", "null", "undefined"}}},
+		{"user_id": bson.M{"$exists": false}},
+	}}, rangeFilter(key, bson.D{{Name: "user_id", Value: bson.MinKey}}, bson.D{{Name: "user_id", Value: 20}}))
+	assert.Equal(t, bson.M{"$or": []bson.M{
+		{"user_id": bson.M{"$gte": 10}},
+		{"user_id": bson.M{"$type": []string{"string", "symbol", "object", "array", "binData", "objectId", "bool", "date", "timestamp", "regex", "maxKey"}}},
+	}}, rangeFilter(key, bson.D{{Name: "user_id", Value: 10}}, bson.D{{Name: "user_id", Value: bson.MaxKey}}))
+	assert.Equal(t, bson.M{"$and": []bson.M{
+		{"$or": []bson.M{
+			{"user_id": bson.M{"$gte": 10}},
+			{"user_id": bson.M{"$type": []string{"string", "symbol", "object", "array", "binData", "objectId", "bool", "date", "timestamp", "regex", "maxKey"}}},
+		}},
+		{"$or": []bson.M{
+			{"user_id": bson.M{"$lt": "m"}},
+			{"user_id": bson.M{"$type": []string{"minKey", "null", "undefined", "double", "int", "long", "decimal"}}},
+			{"user_id": bson.M{"$exists": false}},
+		}},
+	}}, rangeFilter(key, bson.D{{Name: "user_id", Value: 10}}, bson.D{{Name: "user_id", Value: "m"}}))
+}
+
+func TestRangeFilterCompound(t *testing.T) {
+	key := bson.D{{Name: "country", Value: 1}, {Name: "user_id", Value: 1}}
+
+	filter := rangeFilter(key,
+		bson.D{{Name: "country", Value: "fr"}, {Name: "user_id", Value: bson.MaxKey}},
+		bson.D{{Name: "country", Value: "us"}, {Name: "user_id", Value: bson.MinKey}})
+	assert.Equal(t, bson.M{"$and": []bson.M{
+		{"$or": []bson.M{
+			{"$or": []bson.M{
+				{"country": bson.M{"$gt": "fr"}},
+				{"country": bson.M{"$type": []string{"object", "array", "binData", "objectId", "bool", "date", "timestamp", "regex", "maxKey"}}},
+			}},
+			{"$and": []bson.M{{"country": "fr"}, {"user_id": bson.M{"$gte": bson.MaxKey}}}},
+		}},
+		{"$or": []bson.M{
+			{"$or": []bson.M{
+				{"country": bson.M{"$lt": "us"}},
+				{"country": bson.M{"$type": []string{"minKey", "null", "undefined", "double", "int", "long", "decimal"}}},
+				{"country": bson.M{"$exists": false}},
+			}},
+			{"$and": []bson.M{{"country": "us"}, {"user_id": bson.M{"$lt": bson.MinKey}}}},
+		}},
+	}}, filter)
+}
+
+func TestGroupChunks(t *testing.T) {
+	chunks := []chunk{
+		{Min: bson.D{{Name: "a", Value: bson.MinKey}}, Max: bson.D{{Name: "a", Value: 10}}, Shard: "rs0"},
+		{Min: bson.D{{Name: "a", Value: 10}}, Max: bson.D{{Name: "a", Value: 20}}, Shard: "rs1"},
+		{Min: bson.D{{Name: "a", Value: 20}}, Max: bson.D{{Name: "a", Value: bson.MaxKey}}, Shard: "rs0"},
+	}
+	byShard := groupChunks(chunks)
+	assert.Len(t, byShard, 2)
+	assert.Equal(t, []chunk{chunks[0], chunks[2]}, byShard["rs0"])
+	assert.Equal(t, []chunk{chunks[1]}, byShard["rs1"])
+}
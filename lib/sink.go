@@ -0,0 +1,379 @@
+package mongodb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cenkalti/backoff"
+	"github.com/segmentio/go-tableize"
+	"github.com/segmentio/objects-go"
+	"github.com/tj/go-sync/semaphore"
+	"gopkg.in/validator.v2"
+)
+
+// SinkConfig configures the delivery of objects to the Objects API. The defaults are those of
+// objects-go, except for the timeout of requests, which objects-go has none of.
+type SinkConfig struct {
+	// Endpoint is the base URL of the Objects API, e.g. of a proxy or a local test server. A
+	// trailing slash is ignored.
+	Endpoint string
+	// MaxBatchCount and MaxBatchBytes bound the batches of objects sent in a single request.
+	MaxBatchCount int
+	MaxBatchBytes int
+	// MaxBatchInterval is how long objects wait for their batch to fill up before it is sent.
+	MaxBatchInterval time.Duration
+	// Timeout of each HTTP request, 0 for none.
+	Timeout time.Duration
+	// Parallelism is the number of requests sent at the same time.
+	Parallelism int
+	// RetryMaxElapsed is the time allowed for retrying a failed request, 0 to fail right away.
+	RetryMaxElapsed time.Duration
+}
+
+func NewSinkConfig() *SinkConfig {
+	return &SinkConfig{
+		Endpoint:         objects.DefaultBaseEndpoint,
+		MaxBatchCount:    100,
+		MaxBatchBytes:    500 << 10,
+		MaxBatchInterval: 10 * time.Second,
+		Timeout:          30 * time.Second,
+		Parallelism:      10,
+		RetryMaxElapsed:  10 * time.Second,
+	}
+}
+
+func (c *SinkConfig) Validate() error {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("endpoint must be an http or https URL")
+	}
+	if c.MaxBatchCount <= 0 {
+		return fmt.Errorf("max batch count must be positive")
+	}
+	if c.MaxBatchBytes <= 0 {
+		return fmt.Errorf("max batch bytes must be positive")
+	}
+	if c.MaxBatchInterval <= 0 {
+		return fmt.Errorf("max batch interval must be positive")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("HTTP timeout must not be negative")
+	}
+	if c.Parallelism <= 0 {
+		return fmt.Errorf("parallel requests must be positive")
+	}
+	if c.RetryMaxElapsed < 0 {
+		return fmt.Errorf("delivery retry time must not be negative")
+	}
+	return nil
+}
+
+// Durations are reported as text, and credentials of the endpoint are left out.
+func (c *SinkConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Endpoint         string `json:"endpoint"`
+		MaxBatchCount    int    `json:"max_batch_count"`
+		MaxBatchBytes    int    `json:"max_batch_bytes"`
+		MaxBatchInterval string `json:"max_batch_interval"`
+		Timeout          string `json:"timeout"`
+		Parallelism      int    `json:"parallelism"`
+		RetryMaxElapsed  string `json:"retry_max_elapsed"`
+	}{
+		Endpoint:         uriCredentials.ReplaceAllString(c.Endpoint, "${1}"+Redacted+"@"),
+		MaxBatchCount:    c.MaxBatchCount,
+		MaxBatchBytes:    c.MaxBatchBytes,
+		MaxBatchInterval: c.MaxBatchInterval.String(),
+		Timeout:          c.Timeout.String(),
+		Parallelism:      c.Parallelism,
+		RetryMaxElapsed:  c.RetryMaxElapsed.String(),
+	})
+}
+
+// The body of a request to the Objects API.
+type sinkBatch struct {
+	Collection string          `json:"collection"`
+	WriteKey   string          `json:"write_key"`
+	Objects    json.RawMessage `json:"objects"`
+
+	count int
+}
+
+// Objects of a collection waiting to be sent.
+type sinkBuffer struct {
+	objects [][]byte
+	size    int
+}
+
+// Sink delivers objects to the Objects API in batches, like the objects-go client, with all its
+// settings exposed. Objects are batched by collection; a batch is sent once full, or after the
+// maximum interval.
+type Sink struct {
+	config   SinkConfig
+	writeKey string
+	client   *http.Client
+	requests semaphore.Semaphore
+
+	mu      sync.Mutex
+	buffers map[string]*sinkBuffer
+	closed  bool
+	// Batches taken from the buffers and not delivered yet.
+	pending sync.WaitGroup
+	// Outcome of the deliveries, by collection.
+	deliveries map[string]*DeliveryReport
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewSink(writeKey string, config *SinkConfig) *Sink {
+	s := &Sink{
+		config:     *config,
+		writeKey:   writeKey,
+		client:     &http.Client{Timeout: config.Timeout},
+		requests:   make(semaphore.Semaphore, config.Parallelism),
+		buffers:    make(map[string]*sinkBuffer),
+		deliveries: make(map[string]*DeliveryReport),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	s.config.Endpoint = strings.TrimRight(config.Endpoint, "/")
+	go s.tick()
+	return s
+}
+
+// Set queues an object for delivery. Properties are tableized as by objects-go. Objects that are
+// invalid, e.g. documents none of whose fields are exported, are rejected rather than failed, as
+// no delivery would ever accept them.
+func (s *Sink) Set(o *objects.Object) error {
+	if err := validator.Validate(o); err != nil {
+		s.reject(o.Collection)
+		return err
+	}
+	b, err := json.Marshal(&objects.Object{ID: o.ID, Properties: tableize.Tableize(o.Properties)})
+	if err != nil {
+		s.record(o.Collection, 0, 1, 0, err)
+		return err
+	}
+
+	var full []*sinkBatch
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return objects.ErrClientClosed
+	}
+	buffer, ok := s.buffers[o.Collection]
+	if !ok {
+		buffer = &sinkBuffer{}
+		s.buffers[o.Collection] = buffer
+	}
+	if len(buffer.objects) > 0 && buffer.size+len(b) > s.config.MaxBatchBytes {
+		full = append(full, s.take(o.Collection, buffer))
+	}
+	buffer.objects = append(buffer.objects, b)
+	buffer.size += len(b)
+	if len(buffer.objects) >= s.config.MaxBatchCount || buffer.size >= s.config.MaxBatchBytes {
+		full = append(full, s.take(o.Collection, buffer))
+	}
+	s.mu.Unlock()
+
+	for _, batch := range full {
+		s.send(batch)
+	}
+	return nil
+}
+
+// Empties a buffer into a batch. Must be called with the lock held.
+func (s *Sink) take(collection string, buffer *sinkBuffer) *sinkBatch {
+	batch := &sinkBatch{
+		Collection: collection,
+		WriteKey:   s.writeKey,
+		Objects:    json.RawMessage("[" + string(bytes.Join(buffer.objects, []byte{','})) + "]"),
+		count:      len(buffer.objects),
+	}
+	buffer.objects = nil
+	buffer.size = 0
+	s.pending.Add(1)
+	return batch
+}
+
+// Empties all the buffers. Must be called with the lock held.
+func (s *Sink) takeAll() []*sinkBatch {
+	var batches []*sinkBatch
+	for collection, buffer := range s.buffers {
+		if len(buffer.objects) > 0 {
+			batches = append(batches, s.take(collection, buffer))
+		}
+	}
+	return batches
+}
+
+// Sends a batch once fewer requests than the parallelism are in flight.
+func (s *Sink) send(batch *sinkBatch) {
+	s.requests.Run(func() {
+		defer s.pending.Done()
+		s.deliver(batch)
+	})
+}
+
+// Sends the batches that waited for the maximum interval.
+func (s *Sink) tick() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.config.MaxBatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		batches := s.takeAll()
+		s.mu.Unlock()
+		for _, batch := range batches {
+			s.send(batch)
+		}
+	}
+}
+
+// Close sends the objects left and waits until all of them were delivered or failed.
+func (s *Sink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return objects.ErrClientClosed
+	}
+	s.closed = true
+	batches := s.takeAll()
+	s.mu.Unlock()
+
+	close(s.stop)
+	<-s.done
+	for _, batch := range batches {
+		s.send(batch)
+	}
+	s.pending.Wait()
+	return nil
+}
+
+// Delivers a batch, retrying failed requests until the time allowed elapsed. Network errors,
+// throttling and server errors are retried, other client errors are not.
+func (s *Sink) deliver(batch *sinkBatch) {
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		logrus.WithError(err).WithField("collection", batch.Collection).Error("Unable to encode batch")
+		s.record(batch.Collection, 0, batch.count, 0, err)
+		return
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = s.config.RetryMaxElapsed
+	b.Reset()
+	for {
+		status, err := s.post(payload)
+		if err == nil {
+			s.record(batch.Collection, batch.count, 0, status, nil)
+			return
+		}
+		next := backoff.Stop
+		if s.config.RetryMaxElapsed > 0 && (status == 0 || status == http.StatusTooManyRequests || status >= 500) {
+			next = b.NextBackOff()
+		}
+		if next == backoff.Stop {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"collection": batch.Collection,
+				"objects":    batch.count,
+				"status":     status,
+			}).Error("Batch delivery failed")
+			s.record(batch.Collection, 0, batch.count, status, err)
+			return
+		}
+		time.Sleep(next)
+	}
+}
+
+// DeliveryReport is the outcome of the delivery of the objects of a collection.
+type DeliveryReport struct {
+	// Accepted and Failed count objects, those of failed batches and those that could not be
+	// encoded. Rejected counts the invalid objects, which are not sent.
+	Accepted int `json:"accepted"`
+	Failed   int `json:"failed"`
+	Rejected int `json:"rejected,omitempty"`
+	// LastStatus is the HTTP status of the last response, 0 if there was none.
+	LastStatus int `json:"last_status,omitempty"`
+	// LastError is the error of the last failure.
+	LastError string `json:"last_error,omitempty"`
+}
+
+func (s *Sink) record(collection string, accepted, failed, status int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := s.delivery(collection)
+	report.Accepted += accepted
+	report.Failed += failed
+	if status != 0 {
+		report.LastStatus = status
+	}
+	if err != nil {
+		report.LastError = err.Error()
+	}
+}
+
+func (s *Sink) reject(collection string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delivery(collection).Rejected++
+}
+
+// Returns the report of the deliveries of a collection. Must be called with the lock held.
+func (s *Sink) delivery(collection string) *DeliveryReport {
+	report, ok := s.deliveries[collection]
+	if !ok {
+		report = &DeliveryReport{}
+		s.deliveries[collection] = report
+	}
+	return report
+}
+
+// Deliveries returns the outcome of the deliveries so far, by collection.
+func (s *Sink) Deliveries() map[string]*DeliveryReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deliveries := make(map[string]*DeliveryReport, len(s.deliveries))
+	for collection, report := range s.deliveries {
+		delivery := *report
+		deliveries[collection] = &delivery
+	}
+	return deliveries
+}
+
+// Posts a batch and returns the HTTP status, 0 if there was no response.
+func (s *Sink) post(payload []byte) (int, error) {
+	req, err := http.NewRequest("POST", s.config.Endpoint+"/v1/set", bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("objects API responded %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,109 @@
+package mongodb
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/segmentio/objects-go"
+)
+
+// CollectionState is what we remember about a collection between two runs.
+type CollectionState struct {
+	// Hash of the properties of every object published by the last successful scan, by destination
+	// collection and object id. A single collection may publish to several destinations, e.g. when
+	// arrays are exploded into child collections.
+	Objects map[string]map[string]string `json:"objects"`
+}
+
+func NewCollectionState() *CollectionState {
+	return &CollectionState{
+		Objects: make(map[string]map[string]string),
+	}
+}
+
+// Hash returns the hash recorded for the object, or an empty string if there is none.
+func (s *CollectionState) Hash(o *objects.Object) string {
+	return s.Objects[o.Collection][o.ID]
+}
+
+// SetHash records the hash of the object.
+func (s *CollectionState) SetHash(o *objects.Object, hash string) {
+	ids, ok := s.Objects[o.Collection]
+	if !ok {
+		ids = make(map[string]string)
+		s.Objects[o.Collection] = ids
+	}
+	ids[o.ID] = hash
+}
+
+// StateStore persists collection states on the local disk, one JSON file per collection.
+type StateStore struct {
+	dir string
+}
+
+func NewStateStore(dir string) (*StateStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &StateStore{dir: dir}, nil
+}
+
+// Load returns the state saved for the collection, or an empty state if there is none yet.
+func (s *StateStore) Load(dbName, collectionName string) (*CollectionState, error) {
+	state := NewCollectionState()
+
+	f, err := os.Open(s.path(dbName, collectionName))
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(state); err != nil {
+		return nil, err
+	}
+	if state.Objects == nil {
+		state.Objects = make(map[string]map[string]string)
+	}
+	return state, nil
+}
+
+// Save replaces the state of the collection. The file is written aside and renamed so that a
+// crash mid-write never leaves a truncated state behind.
+func (s *StateStore) Save(dbName, collectionName string, state *CollectionState) error {
+	path := s.path(dbName, collectionName)
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(state); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (s *StateStore) path(dbName, collectionName string) string {
+	return filepath.Join(s.dir, dbName+"."+collectionName+".json")
+}
+
+// Returns a compact hash of the properties of an object. JSON encoding sorts map keys, so the same
+// properties always hash the same.
+func hashProperties(properties map[string]interface{}) (string, error) {
+	b, err := json.Marshal(properties)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:16]), nil
+}
@@ -0,0 +1,117 @@
+package mongodb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/segmentio/objects-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateStoreRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongodb-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewStateStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing saved yet, we get an empty state back.
+	state, err := store.Load(database, collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, state.Objects)
+
+	state.SetHash(&objects.Object{ID: "a", Collection: "products"}, "hash-a")
+	state.SetHash(&objects.Object{ID: "a_0", Collection: "products_tags"}, "hash-a-0")
+	if err := store.Save(database, collection, state); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err = store.Load(database, collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "hash-a", state.Hash(&objects.Object{ID: "a", Collection: "products"}))
+	assert.Equal(t, "hash-a-0", state.Hash(&objects.Object{ID: "a_0", Collection: "products_tags"}))
+	assert.Equal(t, "", state.Hash(&objects.Object{ID: "a", Collection: "products_tags"}))
+}
+
+func TestFindDeletedIDs(t *testing.T) {
+	previous := map[string]string{"d": "", "a": "", "b": "", "c": ""}
+	current := map[string]string{"a": "", "c": ""}
+	assert.Equal(t, []string{"b", "d"}, findDeletedIDs(previous, current))
+	assert.Equal(t, []string{}, findDeletedIDs(nil, current))
+}
+
+func TestNewTombstone(t *testing.T) {
+	deletedAt := time.Date(2016, 7, 15, 0, 0, 0, 0, time.UTC)
+	o := newTombstone("abc123", "test_products", deletedAt)
+
+	assert.Equal(t, "abc123", o.ID)
+	assert.Equal(t, "test_products", o.Collection)
+	assert.Equal(t, map[string]interface{}{DeletedProperty: deletedAt}, o.Properties)
+}
+
+func TestHashProperties(t *testing.T) {
+	a, err := hashProperties(map[string]interface{}{"name": "Apple", "cost": 1.27})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := hashProperties(map[string]interface{}{"cost": 1.27, "name": "Apple"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := hashProperties(map[string]interface{}{"name": "Apple", "cost": 1.28})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, a, b, "hash must not depend on key order")
+	assert.NotEqual(t, a, c)
+	assert.Len(t, a, 22)
+}
+
+func TestSavePendingStates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mongodb-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewStateStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending := func(collection, destination string) *pendingState {
+		state := NewCollectionState()
+		state.SetHash(&objects.Object{ID: "a", Collection: destination}, "hash-a")
+		return &pendingState{collection: collection, state: state, destinations: map[string]bool{destination: true}}
+	}
+	report := NewReport(database)
+	savePendingStates(store, database, []*pendingState{pending("users", "test_users"), pending("orders", "test_orders")}, map[string]*DeliveryReport{
+		"test_users":  {Accepted: 1, Rejected: 1},
+		"test_orders": {Failed: 1},
+	}, report)
+	assert.Empty(t, report.Errors)
+
+	// The state of a collection with undelivered objects is not saved, rejected objects do not count.
+	users, err := store.Load(database, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "hash-a", users.Hash(&objects.Object{ID: "a", Collection: "test_users"}))
+	orders, err := store.Load(database, "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, orders.Objects)
+}
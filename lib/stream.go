@@ -0,0 +1,286 @@
+package mongodb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cenkalti/backoff"
+	"github.com/segmentio/objects-go"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// How long a read of the oplog waits for new entries before checking whether to stop.
+const oplogTailTimeout = time.Second
+
+// An entry of the oplog. Multi-document transactions are logged as a single command entry applying
+// all their operations.
+type oplogEntry struct {
+	Ts bson.MongoTimestamp `bson:"ts"`
+	Op string              `bson:"op"`
+	NS string              `bson:"ns"`
+	O  bson.Raw            `bson:"o"`
+	O2 bson.Raw            `bson:"o2"`
+}
+
+// Returns the inserts, updates and deletes of the entry, which are several for transactions.
+func (e *oplogEntry) operations() ([]oplogEntry, error) {
+	if e.Op != "c" {
+		return []oplogEntry{*e}, nil
+	}
+	var command struct {
+		ApplyOps []oplogEntry `bson:"applyOps"`
+	}
+	if err := e.O.Unmarshal(&command); err != nil {
+		return nil, err
+	}
+	for i := range command.ApplyOps {
+		command.ApplyOps[i].Ts = e.Ts
+	}
+	return command.ApplyOps, nil
+}
+
+// Returns the `_id` of the document the operation applies to. Updates only log it aside of the
+// change itself.
+func (e *oplogEntry) documentID() (interface{}, error) {
+	raw := e.O
+	if e.Op == "u" {
+		raw = e.O2
+	}
+	var doc struct {
+		ID interface{} `bson:"_id"`
+	}
+	if err := raw.Unmarshal(&doc); err != nil {
+		return nil, err
+	}
+	if doc.ID == nil {
+		return nil, fmt.Errorf("oplog entry %q on %s has no _id", e.Op, e.NS)
+	}
+	return doc.ID, nil
+}
+
+// Returns the filter of the oplog entries of the namespaces after a position. Writes of chunk
+// migrations are not changes of the data, and are skipped.
+func oplogFilter(namespaces []string, after bson.MongoTimestamp) bson.M {
+	return bson.M{
+		"ts":          bson.M{"$gt": after},
+		"fromMigrate": bson.M{"$exists": false},
+		"$or": []bson.M{
+			{"ns": bson.M{"$in": namespaces}, "op": bson.M{"$in": []string{"i", "u", "d"}}},
+			{"ns": "admin.$cmd", "op": "c", "o.applyOps": bson.M{"$exists": true}},
+		},
+	}
+}
+
+func (m *MongoDB) oplog(session *mgo.Session) *mgo.Collection {
+	return session.DB("local").C("oplog.rs")
+}
+
+// Returns the position of the oplog, i.e. the time of its last entry. Only members of a replica set
+// have an oplog.
+func (m *MongoDB) oplogPosition() (bson.MongoTimestamp, error) {
+	var last oplogEntry
+	if err := m.oplog(m.db.Session).Find(nil).Sort("-$natural").One(&last); err != nil {
+		return 0, fmt.Errorf("unable to read the oplog, streaming requires a replica set: %v", err)
+	}
+	return last.Ts, nil
+}
+
+// Fails if entries after the position were already dropped from the oplog, in which case
+// streaming from it would silently miss changes.
+func (m *MongoDB) checkOplogCovers(position bson.MongoTimestamp) error {
+	var first oplogEntry
+	if err := m.oplog(m.db.Session).Find(nil).Sort("$natural").One(&first); err != nil {
+		return err
+	}
+	if first.Ts > position {
+		return fmt.Errorf("the oplog no longer goes back to %v, the scan outlasted its window", newTimestamp(position))
+	}
+	return nil
+}
+
+// Objects exported so far, to skip publishing the same version of an object twice.
+type exportedObjects struct {
+	mu    sync.Mutex
+	state *CollectionState
+}
+
+func newExportedObjects() *exportedObjects {
+	return &exportedObjects{state: NewCollectionState()}
+}
+
+// Records the object and reports whether it differs from the version exported last.
+func (e *exportedObjects) changed(o *objects.Object) bool {
+	hash, err := hashProperties(o.Properties)
+	if err != nil {
+		return true
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.state.Hash(o) == hash {
+		return false
+	}
+	e.state.SetHash(o, hash)
+	return true
+}
+
+// Forgets a deleted object, so that it is published again if a document with the same id is
+// inserted afterwards.
+func (e *exportedObjects) forget(destinationName, id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.state.Objects[destinationName], id)
+}
+
+// Publishes the changes of the collections logged in the oplog after a position, until stop is
+// closed. Inserted and updated documents are read again rather than rebuilt from the oplog, so
+// that they are exported with the same fields and references as by a scan; objects identical to
+// the version exported last, e.g. by the scan that preceded, are skipped. Deleted documents are
+// published as tombstones.
+func (m *MongoDB) stream(collections []*Collection, from bson.MongoTimestamp, exported *exportedObjects, publish func(o *objects.Object), report *Report, stop <-chan struct{}) error {
+	if err := m.checkOplogCovers(from); err != nil {
+		return err
+	}
+
+	byNamespace := make(map[string]*Collection)
+	var namespaces []string
+	for _, c := range collections {
+		if c.IsVirtual() || (c.Kind != "" && c.Kind != KindCapped) {
+			logrus.WithFields(logrus.Fields{"collection": c.CollectionName, "kind": c.Kind}).Warn("Changes of aggregations, views and time series are not streamed")
+			continue
+		}
+		ns := m.DBName + "." + c.CollectionName
+		byNamespace[ns] = c
+		namespaces = append(namespaces, ns)
+	}
+	if len(namespaces) == 0 {
+		return nil
+	}
+
+	// Changed documents are read again on the primary, which has applied the change already, even
+	// when the scans read secondaries.
+	primary := m.db.Session.Copy()
+	defer primary.Close()
+	primary.SetMode(mgo.Strong, true)
+	db := primary.DB(m.DBName)
+
+	handle := func(e *oplogEntry) error {
+		operations, err := e.operations()
+		if err != nil {
+			return err
+		}
+		for _, op := range operations {
+			c, ok := byNamespace[op.NS]
+			if !ok {
+				continue
+			}
+			if err := m.applyOperation(db, c, &op, exported, publish, report); err != nil {
+				return err
+			}
+		}
+		report.recordStreamPosition(newTimestamp(e.Ts))
+		return nil
+	}
+
+	logrus.WithFields(logrus.Fields{"from": newTimestamp(from), "collections": len(namespaces)}).Info("Streaming changes")
+	position := from
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = m.retryMaxElapsed
+	b.Reset()
+	for {
+		before := position
+		var err error
+		position, err = m.tailOplog(namespaces, position, handle, stop)
+		if err == nil || m.retryMaxElapsed <= 0 || !isRetryable(err) {
+			return err
+		}
+		if position > before {
+			b.Reset()
+		}
+		next := b.NextBackOff()
+		if next == backoff.Stop {
+			return err
+		}
+		logrus.WithError(err).WithFields(logrus.Fields{"position": newTimestamp(position), "retry_in": next}).Warn("Reading the oplog failed, reading it again")
+		time.Sleep(next)
+	}
+}
+
+// Handles the oplog entries of the namespaces after a position until stop is closed, and returns
+// the position of the last entry handled.
+func (m *MongoDB) tailOplog(namespaces []string, position bson.MongoTimestamp, handle func(e *oplogEntry) error, stop <-chan struct{}) (bson.MongoTimestamp, error) {
+	session := m.db.Session.Copy()
+	defer session.Close()
+	session.Refresh()
+
+	for {
+		iter := m.oplog(session).Find(oplogFilter(namespaces, position)).LogReplay().Tail(oplogTailTimeout)
+		for {
+			select {
+			case <-stop:
+				return position, iter.Close()
+			default:
+			}
+			var e oplogEntry
+			if iter.Next(&e) {
+				if err := handle(&e); err != nil {
+					iter.Close()
+					return position, err
+				}
+				position = e.Ts
+				continue
+			}
+			if !iter.Timeout() {
+				break
+			}
+		}
+		// The cursor is dead, e.g. the oplog had no matching entry yet, so it is opened again.
+		if err := iter.Close(); err != nil {
+			return position, err
+		}
+		time.Sleep(oplogTailTimeout)
+	}
+}
+
+// Publishes the change of a document logged by an operation, reading the document from db.
+func (m *MongoDB) applyOperation(db *mgo.Database, c *Collection, op *oplogEntry, exported *exportedObjects, publish func(o *objects.Object), report *Report) error {
+	documentID, err := op.documentID()
+	if err != nil {
+		return err
+	}
+
+	if op.Op == "d" {
+		id, err := getIdFromResult(map[string]interface{}{"_id": documentID})
+		if err != nil {
+			return err
+		}
+		destinationName := m.destinationName(c)
+		exported.forget(destinationName, id)
+		publish(newTombstone(id, destinationName, time.Unix(int64(op.Ts>>32), 0).UTC()))
+		report.recordStreamEvent(true)
+		return nil
+	}
+
+	// The document read now includes this change and possibly later ones, whose entries then find
+	// it exported already.
+	published := false
+	publishChanged := func(o *objects.Object) {
+		if exported.changed(o) {
+			published = true
+			publish(o)
+		}
+	}
+	iter := find(db, c, m.cursor.merge(c.Cursor), bson.M{"_id": documentID}, c.projection(), false).Iter()
+	throttle := func(size int) error {
+		m.limiter.wait(size)
+		return nil
+	}
+	if err := m.scanIter(c, iter, throttle, publishChanged, &cursorProgress{}); err != nil {
+		return err
+	}
+	report.recordStreamEvent(published)
+	return nil
+}
@@ -0,0 +1,85 @@
+package mongodb
+
+import (
+	"testing"
+
+	"github.com/segmentio/objects-go"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func oplogRaw(t *testing.T, doc interface{}) bson.Raw {
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bson.Raw{Kind: 0x03, Data: b}
+}
+
+func TestOplogEntryDocumentID(t *testing.T) {
+	id := bson.NewObjectId()
+	insert := &oplogEntry{Op: "i", NS: "test.users", O: oplogRaw(t, bson.M{"_id": id, "name": "ana"})}
+	documentID, err := insert.documentID()
+	assert.NoError(t, err)
+	assert.Equal(t, id, documentID)
+
+	update := &oplogEntry{Op: "u", NS: "test.users", O: oplogRaw(t, bson.M{"$set": bson.M{"name": "bo"}}), O2: oplogRaw(t, bson.M{"_id": 42})}
+	documentID, err = update.documentID()
+	assert.NoError(t, err)
+	assert.Equal(t, 42, documentID)
+
+	invalid := &oplogEntry{Op: "d", NS: "test.users", O: oplogRaw(t, bson.M{"name": "bo"})}
+	_, err = invalid.documentID()
+	assert.Error(t, err)
+}
+
+func TestOplogEntryOperations(t *testing.T) {
+	ts := bson.MongoTimestamp(1468540800<<32 | 3)
+	insert := &oplogEntry{Ts: ts, Op: "i", NS: "test.users", O: oplogRaw(t, bson.M{"_id": 1})}
+	operations, err := insert.operations()
+	assert.NoError(t, err)
+	assert.Equal(t, []oplogEntry{*insert}, operations)
+
+	transaction := &oplogEntry{Ts: ts, Op: "c", NS: "admin.$cmd", O: oplogRaw(t, bson.M{"applyOps": []bson.M{
+		{"op": "i", "ns": "test.users", "o": bson.M{"_id": 1}},
+		{"op": "d", "ns": "test.orders", "o": bson.M{"_id": 2}},
+	}})}
+	operations, err = transaction.operations()
+	assert.NoError(t, err)
+	if assert.Len(t, operations, 2) {
+		assert.Equal(t, "test.users", operations[0].NS)
+		assert.Equal(t, "d", operations[1].Op)
+		assert.Equal(t, ts, operations[1].Ts)
+		documentID, err := operations[1].documentID()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, documentID)
+	}
+}
+
+func TestExportedObjects(t *testing.T) {
+	exported := newExportedObjects()
+	o := &objects.Object{ID: "1", Collection: "users", Properties: map[string]interface{}{"name": "ana"}}
+	assert.True(t, exported.changed(o))
+	assert.False(t, exported.changed(o), "same version")
+
+	newer := &objects.Object{ID: "1", Collection: "users", Properties: map[string]interface{}{"name": "bo"}}
+	assert.True(t, exported.changed(newer))
+	assert.True(t, exported.changed(&objects.Object{ID: "1", Collection: "orders", Properties: newer.Properties}), "other destination")
+
+	exported.forget("users", "1")
+	assert.True(t, exported.changed(newer), "inserted again after a delete")
+}
+
+func TestReportStream(t *testing.T) {
+	report := NewReport("test")
+	report.recordStreamFrom(&Timestamp{T: 1468540800, I: 1})
+	report.recordStreamEvent(true)
+	report.recordStreamEvent(false)
+	report.recordStreamPosition(&Timestamp{T: 1468540860, I: 2})
+	assert.Equal(t, &StreamReport{
+		From:       &Timestamp{T: 1468540800, I: 1},
+		Position:   &Timestamp{T: 1468540860, I: 2},
+		Changes:    2,
+		Duplicates: 1,
+	}, report.Stream)
+}
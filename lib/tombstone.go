@@ -0,0 +1,35 @@
+package mongodb
+
+import (
+	"sort"
+	"time"
+
+	"github.com/segmentio/objects-go"
+)
+
+// DeletedProperty is the property set on the tombstone published for a document that no longer
+// exists in Mongo. Its value is the time the deletion was detected. The name is left as is when
+// properties get tableized, and is unlikely to be a field of the documents too.
+const DeletedProperty = "segment_deleted_at"
+
+func newTombstone(id string, destinationName string, deletedAt time.Time) *objects.Object {
+	return &objects.Object{
+		ID:         id,
+		Collection: destinationName,
+		Properties: map[string]interface{}{
+			DeletedProperty: deletedAt,
+		},
+	}
+}
+
+// Returns the sorted ids that were seen in the previous run but not in the current one.
+func findDeletedIDs(previous, current map[string]string) []string {
+	deleted := []string{}
+	for id := range previous {
+		if _, ok := current[id]; !ok {
+			deleted = append(deleted, id)
+		}
+	}
+	sort.Strings(deleted)
+	return deleted
+}
@@ -0,0 +1,90 @@
+package mongodb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Transforms applied to the value of a field before it is published, to keep personal data such as
+// emails or phone numbers out of the warehouse.
+const (
+	// TransformDrop never publishes the field. Useful with wildcards.
+	TransformDrop = "drop"
+	// TransformSHA256 publishes the hex SHA-256 of the value prefixed with Field.Salt.
+	TransformSHA256 = "sha256"
+	// TransformHMAC publishes the hex HMAC-SHA256 of the value keyed with Field.Key.
+	TransformHMAC = "hmac"
+	// TransformTruncate publishes the first Field.Length characters of the value.
+	TransformTruncate = "truncate"
+	// TransformMask replaces all but the last Field.Length characters of the value with `*`.
+	TransformMask = "mask"
+)
+
+var transforms = []string{TransformDrop, TransformSHA256, TransformHMAC, TransformTruncate, TransformMask}
+
+func (f *Field) validateTransform() error {
+	switch f.Transform {
+	case "", TransformDrop, TransformSHA256:
+	case TransformHMAC:
+		if f.Key == "" {
+			return fmt.Errorf("field %q: transform %q requires a key", f.FieldName, f.Transform)
+		}
+	case TransformTruncate:
+		if f.Length <= 0 {
+			return fmt.Errorf("field %q: transform %q requires a positive length", f.FieldName, f.Transform)
+		}
+	case TransformMask:
+		if f.Length < 0 {
+			return fmt.Errorf("field %q: transform %q requires a length of at least 0", f.FieldName, f.Transform)
+		}
+	default:
+		return fmt.Errorf("field %q: unknown transform %q, expected one of %v", f.FieldName, f.Transform, transforms)
+	}
+	return nil
+}
+
+// Applies the transform of the field to a value. Anything but a string is first formatted, or
+// serialized to JSON for sub-documents, so that no part of the raw value is ever published. Returns
+// false if the value must not be published at all.
+func (f *Field) applyTransform(value interface{}) (interface{}, bool) {
+	if f == nil || f.Transform == "" {
+		return value, true
+	}
+	if f.Transform == TransformDrop {
+		return nil, false
+	}
+
+	s, err := stringify(value)
+	if err != nil {
+		return nil, false
+	}
+
+	switch f.Transform {
+	case TransformSHA256:
+		sum := sha256.Sum256([]byte(f.Salt + s))
+		return hex.EncodeToString(sum[:]), true
+	case TransformHMAC:
+		mac := hmac.New(sha256.New, []byte(f.Key))
+		mac.Write([]byte(s))
+		return hex.EncodeToString(mac.Sum(nil)), true
+	case TransformTruncate:
+		runes := []rune(s)
+		if len(runes) > f.Length {
+			runes = runes[:f.Length]
+		}
+		return string(runes), true
+	case TransformMask:
+		runes := []rune(s)
+		masked := len(runes) - f.Length
+		if masked < 0 {
+			masked = 0
+		}
+		return strings.Repeat("*", masked) + string(runes[masked:]), true
+	}
+
+	// Unknown transforms are rejected when the schema is parsed, never publish raw values anyway.
+	return nil, false
+}
@@ -0,0 +1,87 @@
+package mongodb
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyTransform(t *testing.T) {
+	cases := []struct {
+		field    *Field
+		value    interface{}
+		expected interface{}
+	}{
+		{nil, "jane@example.com", "jane@example.com"},
+		{&Field{}, 42, 42},
+		{&Field{Transform: TransformSHA256}, "jane@example.com", "8c87b489ce35cf2e2f39f80e282cb2e804932a56a213983eeeb428407d43b52d"},
+		{&Field{Transform: TransformSHA256, Salt: "pepper"}, "jane@example.com", "2daebb07b6fe2686ef59cd504c8b776ad69262a4e97fbc978e5d7851bdc6fe15"},
+		{&Field{Transform: TransformTruncate, Length: 4}, "jane@example.com", "jane"},
+		{&Field{Transform: TransformTruncate, Length: 40}, "jane", "jane"},
+		{&Field{Transform: TransformMask, Length: 4}, "+1 415 555 0100", "***********0100"},
+		{&Field{Transform: TransformMask, Length: 4}, 123, "123"},
+		{&Field{Transform: TransformMask}, "jane", "****"},
+	}
+	for _, c := range cases {
+		value, ok := c.field.applyTransform(c.value)
+		assert.True(t, ok)
+		assert.Equal(t, c.expected, value)
+	}
+
+	_, ok := (&Field{Transform: TransformDrop}).applyTransform("jane@example.com")
+	assert.False(t, ok)
+}
+
+func TestApplyTransformHMAC(t *testing.T) {
+	mac, _ := (&Field{Transform: TransformHMAC, Key: "secret"}).applyTransform("jane@example.com")
+	otherMac, _ := (&Field{Transform: TransformHMAC, Key: "other"}).applyTransform("jane@example.com")
+	macAgain, _ := (&Field{Transform: TransformHMAC, Key: "secret"}).applyTransform("jane@example.com")
+
+	assert.Equal(t, mac, macAgain, "hashes must be stable so they can be joined on")
+	assert.NotEqual(t, mac, otherMac)
+	assert.Len(t, mac, 64)
+}
+
+func TestTransformedValuesNeverPublished(t *testing.T) {
+	schema := `{"test": {"users": {
+		"fields": {
+			"email": {"transform": "sha256", "salt": "pepper"},
+			"phone": {"transform": "mask", "length": 2},
+			"emails": {"transform": "hmac", "key": "secret", "array": "explode"},
+			"profile.**": {"transform": "truncate", "length": 1},
+			"password": {"transform": "drop"},
+			"address": {"transform": "sha256"}
+		},
+		"children": {"contacts": {"fields": {"email": {"transform": "drop"}, "name": null}}}
+	}}}`
+	desc, err := NewDescriptionFromReader(strings.NewReader(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := []string{"jane@example.com", "4155550100", "hunter2", "jdoe@work.com", "Janet", "Main Street", "joe@example.com"}
+	result := map[string]interface{}{
+		"email":    raw[0],
+		"phone":    raw[1],
+		"password": raw[2],
+		"emails":   []interface{}{raw[0], raw[3]},
+		"profile":  map[string]interface{}{"nickname": raw[4]},
+		"address":  map[string]interface{}{"street": raw[5]},
+		"contacts": []interface{}{map[string]interface{}{"email": raw[6], "name": "Joe"}},
+	}
+
+	objs := getObjectsFromResult("u1", result, desc.schemas["test"]["users"], "test_users")
+	b, err := json.Marshal(objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, objs, 4)
+	for _, value := range raw {
+		assert.NotContains(t, string(b), value)
+	}
+	assert.Contains(t, string(b), `"phone":"********00"`)
+	assert.Contains(t, string(b), `"name":"Joe"`)
+}
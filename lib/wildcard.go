@@ -0,0 +1,131 @@
+package mongodb
+
+import (
+	"sort"
+	"strings"
+)
+
+// Field names may select several fields at once with a trailing wildcard: `translations.*` selects
+// every field directly under `translations`, while `address.**` selects every field nested at any
+// depth under `address`. A bare `*` or `**` applies to the whole document.
+const (
+	wildcard          = "*"
+	recursiveWildcard = "**"
+)
+
+// Placeholders of the destination name of a wildcard field, e.g. `translation_{key}`.
+const (
+	// PathPlaceholder is replaced by the full path of the matched field, e.g. `translations.spanish`.
+	PathPlaceholder = "{path}"
+	// KeyPlaceholder is replaced by the part of the path matched by the wildcard, e.g. `spanish`.
+	KeyPlaceholder = "{key}"
+)
+
+func isPattern(fieldName string) bool {
+	_, _, ok := splitPattern(fieldName)
+	return ok
+}
+
+// Splits a wildcard field name into the path it selects fields under and whether the selection is
+// recursive.
+func splitPattern(fieldName string) (prefix string, recursive bool, ok bool) {
+	switch {
+	case fieldName == recursiveWildcard:
+		return "", true, true
+	case fieldName == wildcard:
+		return "", false, true
+	case strings.HasSuffix(fieldName, "."+recursiveWildcard):
+		return strings.TrimSuffix(fieldName, "."+recursiveWildcard), true, true
+	case strings.HasSuffix(fieldName, "."+wildcard):
+		return strings.TrimSuffix(fieldName, "."+wildcard), false, true
+	}
+	return "", false, false
+}
+
+// Returns the values of the fields of the document matched by a wildcard field name, by path.
+// Recursive wildcards only match leaves, i.e. values that are not sub-documents.
+func expandPattern(result map[string]interface{}, fieldName string) map[string]interface{} {
+	prefix, recursive, _ := splitPattern(fieldName)
+
+	root := result
+	if prefix != "" {
+		var ok bool
+		if root, ok = getForNestedKey(result, prefix).(map[string]interface{}); !ok {
+			return nil
+		}
+		prefix += "."
+	}
+
+	matches := make(map[string]interface{})
+	collectMatches(matches, root, prefix, recursive)
+	return matches
+}
+
+func collectMatches(matches map[string]interface{}, m map[string]interface{}, prefix string, recursive bool) {
+	for key, value := range m {
+		if sub, ok := value.(map[string]interface{}); ok && recursive {
+			collectMatches(matches, sub, prefix+key+".", recursive)
+			continue
+		}
+		matches[prefix+key] = value
+	}
+}
+
+// Returns the destination name of a field matched by a wildcard field. Without a template the
+// path of the matched field is used, which gets tableized to e.g. `translations_spanish`.
+func (f *Field) expandDestinationName(path string) string {
+	if f.DestinationName == "" {
+		return path
+	}
+
+	prefix, _, _ := splitPattern(f.FieldName)
+	key := path
+	if prefix != "" {
+		key = strings.TrimPrefix(path, prefix+".")
+	}
+	return strings.NewReplacer(PathPlaceholder, path, KeyPlaceholder, key).Replace(f.DestinationName)
+}
+
+// Returns the paths to fetch for the given field names. Wildcards are replaced by the path they
+// select under, and paths already covered by one of their parents are dropped since Mongo rejects
+// projections with colliding paths. Returns nil if the whole document must be fetched.
+func projectPaths(fieldNames []string) map[string]interface{} {
+	paths := make([]string, 0, len(fieldNames))
+	for _, fieldName := range fieldNames {
+		if prefix, _, ok := splitPattern(fieldName); ok {
+			if prefix == "" {
+				return nil
+			}
+			fieldName = prefix
+		}
+		paths = append(paths, fieldName)
+	}
+
+	// Parents sort before their children.
+	sort.Strings(paths)
+	projection := make(map[string]interface{})
+	for _, path := range paths {
+		if !hasParentPath(projection, path) {
+			projection[path] = 1
+		}
+	}
+	return projection
+}
+
+func hasParentPath(projection map[string]interface{}, path string) bool {
+	for i := strings.Index(path, "."); i != -1; i = nextDot(path, i) {
+		if _, ok := projection[path[:i]]; ok {
+			return true
+		}
+	}
+	_, ok := projection[path]
+	return ok
+}
+
+func nextDot(path string, i int) int {
+	j := strings.Index(path[i+1:], ".")
+	if j == -1 {
+		return -1
+	}
+	return i + 1 + j
+}
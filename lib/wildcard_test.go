@@ -0,0 +1,61 @@
+package mongodb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var wildcardTestDoc = map[string]interface{}{
+	"name": "Apple",
+	"translations": map[string]interface{}{
+		"spanish": "manzana",
+		"french":  "pomme",
+	},
+	"address": map[string]interface{}{
+		"city": "Paris",
+		"geo":  map[string]interface{}{"lat": 48.8, "lng": 2.3},
+	},
+}
+
+func TestExpandPattern(t *testing.T) {
+	assert.Equal(t, map[string]interface{}{
+		"translations.spanish": "manzana",
+		"translations.french":  "pomme",
+	}, expandPattern(wildcardTestDoc, "translations.*"))
+
+	assert.Equal(t, map[string]interface{}{
+		"address.city":    "Paris",
+		"address.geo.lat": 48.8,
+		"address.geo.lng": 2.3,
+	}, expandPattern(wildcardTestDoc, "address.**"))
+
+	assert.Empty(t, expandPattern(wildcardTestDoc, "name.*"))
+	assert.Empty(t, expandPattern(wildcardTestDoc, "missing.**"))
+}
+
+func TestGetPropertiesMapFromResultWildcards(t *testing.T) {
+	c := &Collection{Fields: map[string]*Field{
+		"translations.*":       {FieldName: "translations.*", DestinationName: "translation_{key}"},
+		"translations.spanish": {FieldName: "translations.spanish", DestinationName: "es"},
+		"address.**":           {FieldName: "address.**"},
+	}}
+
+	assert.Equal(t, map[string]interface{}{
+		"es":                 "manzana",
+		"translation_french": "pomme",
+		"address.city":       "Paris",
+		"address.geo.lat":    48.8,
+		"address.geo.lng":    2.3,
+	}, getPropertiesMapFromResult(wildcardTestDoc, c))
+}
+
+func TestProjectPaths(t *testing.T) {
+	assert.Equal(t, map[string]interface{}{
+		"name":         1,
+		"translations": 1,
+		"address":      1,
+	}, projectPaths([]string{"translations.spanish", "name", "translations.*", "address.**", "address.geo.lat"}))
+
+	assert.Nil(t, projectPaths([]string{"name", "**"}))
+}
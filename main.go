@@ -4,11 +4,11 @@ import (
 	"io"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/asaskevich/govalidator"
 	"github.com/segment-sources/mongodb/lib"
-	"github.com/segmentio/objects-go"
 
 	"github.com/segmentio/ecs-logs-go/logrus"
 	"github.com/tj/docopt"
@@ -19,17 +19,58 @@ const (
 	Usage   = `
 Usage:
   mongodb
+    [--config=<path>]
     [--debug]
     [--init]
     [--json-log]
+    [--redact-fields=<fields>]
     [--concurrency=<c>]
     [--schema=<schema-path>]
+    [--state-dir=<path>]
+    [--detect-deletes]
+    [--skip-unchanged]
+    [--force-full]
+    [--include-system]
+    [--shard-parallel]
+    [--batch-size=<n>]
+    [--prefetch=<ratio>]
+    [--no-cursor-timeout]
+    [--max-time-ms=<ms>]
+    [--sort=<fields>]
+    [--hint=<fields>]
+    [--retry-max-elapsed=<duration>]
+    [--max-docs-per-second=<n>]
+    [--max-bytes-per-second=<n>]
+    [--adaptive-rate]
+    [--adaptive-max-queue=<n>]
+    [--adaptive-max-lag=<duration>]
+    [--secondary]
+    [--max-lag=<duration>]
+    [--max-lag-wait=<duration>]
+    [--read-concern=<level>]
+    [--stream]
+    [--report=<path>]
+    [--naming-template=<template>]
+    [--naming-prefix=<prefix>]
+    [--naming-suffix=<suffix>]
+    [--naming-case=<case>]
+    [--naming-max-length=<n>]
+    [--naming-collisions=<mode>]
     [--write-key=<segment-write-key>]
-    --hostname=<hostname>
-    --port=<port>
-    --username=<username>
-    --password=<password>
-    --database=<database>
+    [--write-key-file=<path>]
+    [--endpoint=<url>]
+    [--max-batch-count=<n>]
+    [--max-batch-bytes=<n>]
+    [--max-batch-interval=<duration>]
+    [--http-timeout=<duration>]
+    [--parallel-requests=<n>]
+    [--delivery-retry-max-elapsed=<duration>]
+    [--hostname=<hostname>]
+    [--port=<port>]
+    [--username=<username>]
+    [--password=<password>]
+    [--password-file=<path>]
+    [--database=<database>]
   mongodb -h | --help
   mongodb --version
 
@@ -37,16 +78,64 @@ Options:
     "github.com/segmentio/source-db-lib/internal/domain"
   -h --help                   Show this screen
   --version                   Show version
+  --config=<path>             Read options from a JSON file, flags take precedence
 	[--debug]										Set logrus level to .DebugLevel
 	[--json-log]								Format log as JSON. Useful for ecs-logs for example
+  --redact-fields=<fields>    Comma separated field names whose values are redacted from logs
   --write-key=<key>           Segment source write key
+  --write-key-file=<path>     Read the write key from a file
+  --endpoint=<url>            Base URL of the Objects API [default: https://objects.segment.com]
+  --max-batch-count=<n>       Objects sent per request at most [default: 100]
+  --max-batch-bytes=<n>       Bytes sent per request at most [default: 512000]
+  --max-batch-interval=<duration>  How long objects wait for their batch to fill up [default: 10s]
+  --http-timeout=<duration>   Timeout of requests to the Objects API, 0 for none [default: 30s]
+  --parallel-requests=<n>     Requests to the Objects API sent at the same time [default: 10]
+  --delivery-retry-max-elapsed=<duration>  Time allowed for retrying failed requests, 0 to fail right away [default: 10s]
   --concurrency=<c>           Number of concurrent table scans [default: 1]
   --hostname=<hostname>       Database instance hostname
   --port=<port>               Database instance port number
   --username=<username>       Database instance username
   --password=<password>       Database instance password
+  --password-file=<path>      Read the database instance password from a file
   --database=<database>       Database instance name
   --schema=<schema-path>	    The path to the schema json file [default: schema.json]
+  --state-dir=<path>          Directory where state is kept between runs [default: state]
+  --detect-deletes            Publish a tombstone for documents deleted since the previous run
+  --skip-unchanged            Only publish documents that changed since the previous run
+  --force-full                Publish every document, even with --skip-unchanged
+  --include-system            List system.* collections in the schema generated by --init
+  --shard-parallel            Scan the shards of sharded collections in parallel
+  --batch-size=<n>            Documents fetched per round trip, 0 for the server default [default: 0]
+  --prefetch=<ratio>          Ratio of a batch left when the next one is fetched [default: 0.25]
+  --no-cursor-timeout         Keep idle cursors open on the server
+  --max-time-ms=<ms>          Abort queries running longer than this, 0 for no limit [default: 0]
+  --sort=<fields>             Comma separated fields to sort documents by, - for descending
+  --hint=<fields>             Comma separated key fields of the index to use, - for descending
+  --retry-max-elapsed=<duration>  Time allowed for reopening failed cursors, 0 to fail right away [default: 5m]
+  --max-docs-per-second=<n>   Documents read per second across all collections, 0 for no limit [default: 0]
+  --max-bytes-per-second=<n>  Bytes read per second across all collections, 0 for no limit [default: 0]
+  --adaptive-rate             Slow reads down while the server is under load
+  --adaptive-max-queue=<n>    Operations queued on the server above which it is under load [default: 10]
+  --adaptive-max-lag=<duration>  Replication lag above which the server is under load [default: 10s]
+  --secondary                 Read from secondaries only
+  --max-lag=<duration>        With --secondary, do not read from secondaries lagging more, 0 for no limit [default: 0]
+  --max-lag-wait=<duration>   How long to wait for a secondary to catch up before failing [default: 5m]
+  --read-concern=<level>      Read concern of all reads: local, majority or snapshot
+  --stream                    Stream changes from the oplog after the scans, until interrupted
+  --report=<path>             Save the report of the run as JSON
+  --naming-template=<template>  Destination of collections without destination_name [default: {db}_{collection}]
+  --naming-prefix=<prefix>      Prefix of destination collections without destination_name
+  --naming-suffix=<suffix>      Suffix of destination collections without destination_name
+  --naming-case=<case>          Case of destination names: snake, lower or none [default: snake]
+  --naming-max-length=<n>       Maximum length of destination names, 0 for none [default: 0]
+  --naming-collisions=<mode>    Handling of colliding destination names: ignore, suffix or error [default: ignore]
+
+Precedence:
+  Options given on the command line come first, then environment variables named after the
+  options, SEGMENT_<OPTION> for the write key and the delivery options (e.g. SEGMENT_WRITE_KEY,
+  SEGMENT_ENDPOINT) and MONGODB_<OPTION> for the others (e.g. MONGODB_PASSWORD,
+  MONGODB_BATCH_SIZE), then the configuration file, then the defaults above. The password and
+  write key files apply where the password and write key would, and exclude them.
 `
 )
 
@@ -56,33 +145,195 @@ func main() {
 		logrus.Fatal(err)
 	}
 
+	// Options missing from the command line are taken from the environment, then from the
+	// configuration file.
+	if err := mongodb.ResolveOptions(m, os.Args[1:], os.Environ()); err != nil {
+		logrus.Fatal(err)
+	}
+
 	if m["--debug"].(bool) {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
+	// Secrets are redacted from all log output, along with the sensitive fields of documents.
+	password, _ := m["--password"].(string)
+	writeKey, _ := m["--write-key"].(string)
+	redactFields, _ := m["--redact-fields"].(string)
+	redactor := mongodb.NewRedactor(mongodb.ParseFieldList(redactFields), password, writeKey)
+	formatter := logrus.StandardLogger().Formatter
 	if m["--json-log"].(bool) {
-		logrus.SetFormatter(logrus_ecslogs.NewFormatter())
+		formatter = logrus_ecslogs.NewFormatter()
 	}
+	logrus.SetFormatter(&mongodb.RedactingFormatter{Formatter: formatter, Redactor: redactor})
 
 	concurrency, err := strconv.Atoi(m["--concurrency"].(string))
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
+	namingMaxLength, err := strconv.Atoi(m["--naming-max-length"].(string))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	naming := mongodb.NewNamingPolicy()
+	naming.Template = m["--naming-template"].(string)
+	naming.Prefix, _ = m["--naming-prefix"].(string)
+	naming.Suffix, _ = m["--naming-suffix"].(string)
+	naming.Case = m["--naming-case"].(string)
+	naming.MaxLength = namingMaxLength
+	naming.Collisions = m["--naming-collisions"].(string)
+	if err := naming.Validate(); err != nil {
+		logrus.Fatal(err)
+	}
+
+	batchSize, err := strconv.Atoi(m["--batch-size"].(string))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	prefetch, err := strconv.ParseFloat(m["--prefetch"].(string), 64)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	maxTimeMS, err := strconv.ParseInt(m["--max-time-ms"].(string), 10, 64)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	noCursorTimeout := m["--no-cursor-timeout"].(bool)
+	sort, _ := m["--sort"].(string)
+	hint, _ := m["--hint"].(string)
+	cursor := &mongodb.CursorOptions{
+		BatchSize:       batchSize,
+		Prefetch:        &prefetch,
+		NoCursorTimeout: &noCursorTimeout,
+		MaxTimeMS:       maxTimeMS,
+		Sort:            mongodb.ParseFieldList(sort),
+		Hint:            mongodb.ParseFieldList(hint),
+	}
+	if err := cursor.Validate(); err != nil {
+		logrus.Fatal(err)
+	}
+
+	retryMaxElapsed, err := time.ParseDuration(m["--retry-max-elapsed"].(string))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	maxDocsPerSecond, err := strconv.ParseFloat(m["--max-docs-per-second"].(string), 64)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	maxBytesPerSecond, err := strconv.ParseFloat(m["--max-bytes-per-second"].(string), 64)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	adaptiveMaxQueue, err := strconv.Atoi(m["--adaptive-max-queue"].(string))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	adaptiveMaxLag, err := time.ParseDuration(m["--adaptive-max-lag"].(string))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	rateLimit := &mongodb.RateLimit{
+		DocsPerSecond:  maxDocsPerSecond,
+		BytesPerSecond: maxBytesPerSecond,
+		Adaptive:       m["--adaptive-rate"].(bool),
+		MaxQueue:       adaptiveMaxQueue,
+		MaxLag:         adaptiveMaxLag,
+	}
+	if err := rateLimit.Validate(); err != nil {
+		logrus.Fatal(err)
+	}
+
+	maxLag, err := time.ParseDuration(m["--max-lag"].(string))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	maxLagWait, err := time.ParseDuration(m["--max-lag-wait"].(string))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	reportPath, _ := m["--report"].(string)
+	readConcern, _ := m["--read-concern"].(string)
+	if err := mongodb.ValidateReadConcern(readConcern); err != nil {
+		logrus.Fatal(err)
+	}
+
+	maxBatchCount, err := strconv.Atoi(m["--max-batch-count"].(string))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	maxBatchBytes, err := strconv.Atoi(m["--max-batch-bytes"].(string))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	maxBatchInterval, err := time.ParseDuration(m["--max-batch-interval"].(string))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	httpTimeout, err := time.ParseDuration(m["--http-timeout"].(string))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	parallelRequests, err := strconv.Atoi(m["--parallel-requests"].(string))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	deliveryRetryMaxElapsed, err := time.ParseDuration(m["--delivery-retry-max-elapsed"].(string))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	sink := &mongodb.SinkConfig{
+		Endpoint:         m["--endpoint"].(string),
+		MaxBatchCount:    maxBatchCount,
+		MaxBatchBytes:    maxBatchBytes,
+		MaxBatchInterval: maxBatchInterval,
+		Timeout:          httpTimeout,
+		Parallelism:      parallelRequests,
+		RetryMaxElapsed:  deliveryRetryMaxElapsed,
+	}
+	if err := sink.Validate(); err != nil {
+		logrus.Fatal(err)
+	}
+
+	hostname, _ := m["--hostname"].(string)
+	port, _ := m["--port"].(string)
+	username, _ := m["--username"].(string)
+	database, _ := m["--database"].(string)
+
 	// Load and validate DB configuration.
 	config := &mongodb.Config{
 		Init:     m["--init"].(bool),
-		Hostname: m["--hostname"].(string),
-		Port:     m["--port"].(string),
-		Username: m["--username"].(string),
-		Password: m["--password"].(string),
-		Database: m["--database"].(string),
+		Hostname: hostname,
+		Port:     port,
+		Username: username,
+		Password: password,
+		Database: database,
+
+		Secondary: m["--secondary"].(bool),
+
+		StateDir:      m["--state-dir"].(string),
+		DetectDeletes: m["--detect-deletes"].(bool),
+		SkipUnchanged: m["--skip-unchanged"].(bool),
+		ForceFull:     m["--force-full"].(bool),
+		IncludeSystem: m["--include-system"].(bool),
+		ShardParallel: m["--shard-parallel"].(bool),
+		Cursor:        cursor,
+		Naming:        naming,
+
+		RetryMaxElapsed: retryMaxElapsed,
+		RateLimit:       rateLimit,
+		MaxLag:          maxLag,
+		MaxLagWait:      maxLagWait,
+		ReadConcern:     readConcern,
+		Stream:          m["--stream"].(bool),
+		Sink:            sink,
+		ReportPath:      reportPath,
 	}
 
 	_, err = govalidator.ValidateStruct(config)
 	if err != nil {
-		logrus.Error(err)
-		return
+		logrus.Fatalf("Invalid configuration: %v", err)
 	}
 
 	// If in init mode, save list of collections to schema file. Users will then have to modify the
@@ -94,7 +345,6 @@ func main() {
 	}
 
 	// Build Segment client and define publish function for when we scan over the collections.
-	writeKey := m["--write-key"].(string)
 	if writeKey == "" {
 		logrus.Fatal("Write key is required when not in init mode.")
 	}
@@ -105,18 +355,15 @@ func main() {
 	} else if err != nil {
 		logrus.Fatal("Unable to parse schema", err)
 	}
-
-	segmentClient := objects.New(writeKey)
-	defer segmentClient.Close()
-	setWrapperFunc := func(o *objects.Object) {
-		err := segmentClient.Set(o)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{"id": o.ID, "collection": o.Collection, "properties": o.Properties}).Warn(err)
-		}
+	if description != nil {
+		description.Redact(redactor, naming)
 	}
 
-	logrus.Info("[%v] Mongo source started with writeKey ", Version, writeKey)
-	if err := mongodb.Run(config, description, concurrency, setWrapperFunc); err != nil {
+	// The sink is closed by the run, which fails if objects could not be delivered.
+	segmentClient := mongodb.NewSink(writeKey, sink)
+
+	logrus.Infof("[%v] Mongo source started", Version)
+	if err := mongodb.Run(config, description, concurrency, segmentClient); err != nil {
 		logrus.Error("mongodb source failed to complete", err)
 		os.Exit(1)
 	}